@@ -1,11 +1,35 @@
 package qemuctl_actions
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
 
 type GenericAction interface {
 	Run(arguments []string) error
 }
 
+/* ExitStatusError makes qemuctl exit with Code instead of 0 */
+type ExitStatusError struct {
+	Code int
+}
+
+func (e *ExitStatusError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+/*
+ * getInterruptContext returns a context cancelled on Ctrl-C or SIGTERM.
+ * main's signal handler only logs them, so actions that wait on something
+ * long derive their contexts from this one to stay interruptible.
+ */
+func getInterruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
 type DummyAction struct {
 }
 
@@ -14,20 +38,44 @@ var actionsMap map[string]GenericAction
 func init() {
 	actionsMap = make(map[string]GenericAction, 0)
 
+	actionsMap["agent"] = &AgentAction{}
 	actionsMap["attach"] = &AttachAction{}
+	actionsMap["backup"] = &BackupAction{}
+	actionsMap["balloon"] = &BalloonAction{}
+	actionsMap["cdrom"] = &CDRomAction{}
 	actionsMap["completion"] = &CompletionAction{}
+	actionsMap["console"] = &ConsoleAction{}
+	actionsMap["cp"] = &CopyAction{}
+	actionsMap["cpus"] = &CPUsAction{}
 	actionsMap["create"] = &CreateAction{}
 	actionsMap["destroy"] = &DestroyAction{}
 	actionsMap["disable"] = &DisableAction{}
+	actionsMap["disk"] = &DiskAction{}
 	actionsMap["enable"] = &EnableAction{}
+	actionsMap["events"] = &EventsAction{}
+	actionsMap["exec"] = &ExecAction{}
+	actionsMap["fsfreeze"] = &FsFreezeAction{}
 	actionsMap["help"] = &HelpAction{}
 	actionsMap["info"] = &InfoAction{}
 	actionsMap["kill"] = &KillAction{}
 	actionsMap["list"] = &ListAction{}
+	actionsMap["memory"] = &MemoryAction{}
+	actionsMap["migrate"] = &MigrateAction{}
+	actionsMap["monitor"] = &MonitorAction{}
+	actionsMap["nic"] = &NicAction{}
+	actionsMap["pause"] = &PauseAction{}
+	actionsMap["qmp"] = &QmpAction{}
+	actionsMap["reset"] = &ResetAction{}
+	actionsMap["resume"] = &ResumeAction{}
+	actionsMap["save"] = &SaveAction{}
+	actionsMap["screenshot"] = &ScreenshotAction{}
+	actionsMap["sendkey"] = &SendKeyAction{}
 	actionsMap["service"] = &ServiceAction{}
+	actionsMap["snapshot"] = &SnapshotAction{}
 	actionsMap["start"] = &StartAction{}
 	actionsMap["status"] = &StatusAction{}
 	actionsMap["stop"] = &StopAction{}
+	actionsMap["type"] = &TypeAction{}
 }
 
 func GetActionInterface(action string) (out GenericAction) {
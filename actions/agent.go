@@ -0,0 +1,145 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type AgentAction struct {
+	machineName string
+	timeout     time.Duration
+}
+
+func (action *AgentAction) usage() {
+	fmt.Println("usage: qemuctl agent <machine> ping|info|osinfo|network [-timeout DURATION]")
+}
+
+func (action *AgentAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl agent", flag.ExitOnError)
+
+	if len(arguments) < 2 {
+		action.usage()
+		return fmt.Errorf("machine name and agent command are mandatory")
+	}
+	action.machineName = arguments[0]
+	subCommand := arguments[1]
+
+	flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QgaDefaultTimeout, "time to wait for the guest agent")
+	if err = flagSet.Parse(arguments[2:]); err != nil {
+		return err
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	switch subCommand {
+	case "ping":
+		err = action.handlePing(ctx, qemuMonitor)
+	case "info":
+		err = action.handleInfo(ctx, qemuMonitor)
+	case "osinfo":
+		err = action.handleOSInfo(ctx, qemuMonitor)
+	case "network":
+		err = action.handleNetwork(ctx, qemuMonitor)
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown agent command '%s'", subCommand)
+		}
+	}
+
+	return err
+}
+
+func (action *AgentAction) handlePing(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor) (err error) {
+	fmt.Printf("[qemuctl] pinging guest agent of machine '%s'...", qemuMonitor.Machine.Name)
+
+	if err = qemuMonitor.GuestPing(ctx); err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+	return nil
+}
+
+func (action *AgentAction) handleInfo(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor) (err error) {
+	var enabled []string
+	var disabled []string
+
+	info, err := qemuMonitor.GuestInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, command := range info.SupportedCommands {
+		if command.Enabled {
+			enabled = append(enabled, command.Name)
+		} else {
+			disabled = append(disabled, command.Name)
+		}
+	}
+
+	fmt.Printf("%-20s %s\n", "Agent version:", info.Version)
+	fmt.Printf("%-20s %s\n", "Enabled commands:", strings.Join(enabled, " "))
+	if len(disabled) > 0 {
+		fmt.Printf("%-20s %s\n", "Disabled commands:", strings.Join(disabled, " "))
+	}
+
+	return nil
+}
+
+func (action *AgentAction) handleOSInfo(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor) (err error) {
+	info, err := qemuMonitor.GuestOSInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-16s %s\n", "Name:", runtime.GetValueOrDefault(info.PrettyName, info.Name))
+	fmt.Printf("%-16s %s\n", "ID:", info.ID)
+	fmt.Printf("%-16s %s\n", "Version:", info.Version)
+	fmt.Printf("%-16s %s\n", "Kernel release:", info.KernelRelease)
+	fmt.Printf("%-16s %s\n", "Kernel version:", info.KernelVersion)
+	fmt.Printf("%-16s %s\n", "Architecture:", info.Machine)
+
+	return nil
+}
+
+func (action *AgentAction) handleNetwork(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor) (err error) {
+	interfaces, err := qemuMonitor.GuestNetworkInterfaces(ctx)
+	if err != nil {
+		return err
+	}
+
+	headings := fmt.Sprintf("%-16s %-18s %s", "INTERFACE", "MAC", "ADDRESSES")
+	fmt.Println(headings)
+	fmt.Printf("%s\n", strings.Repeat("-", len(headings)+24))
+
+	for _, guestInterface := range interfaces {
+		var addresses []string
+		for _, address := range guestInterface.IPAddresses {
+			addresses = append(addresses, fmt.Sprintf("%s/%d", address.Address, address.Prefix))
+		}
+
+		fmt.Printf("%-16s %-18s %s\n", guestInterface.Name, guestInterface.HardwareAddress, strings.Join(addresses, " "))
+	}
+
+	return nil
+}
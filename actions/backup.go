@@ -0,0 +1,418 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	BackupActionDefaultTimeout = 1 * time.Hour
+	BackupManifestFileName     = "manifest.json"
+	BackupIDFormat             = "20060102-150405"
+)
+
+type BackupAction struct {
+	machineName   string
+	targetDir     string
+	backupID      string
+	incremental   bool
+	keep          int
+	timeout       time.Duration
+	noFreeze      bool
+	freezeTimeout time.Duration
+}
+
+type backupDisk struct {
+	Source string `json:"source"`
+	Format string `json:"format"`
+	File   string `json:"file"`
+}
+
+/*
+ * backupManifest describes one backup directory. Incremental backups are
+ * qcow2 overlays of their parent's images, so the newest image of a disk
+ * always holds the complete disk contents at that point in time.
+ */
+type backupManifest struct {
+	ID      string       `json:"id"`
+	Machine string       `json:"machine"`
+	Type    string       `json:"type"`
+	Parent  string       `json:"parent,omitempty"`
+	Created time.Time    `json:"created"`
+	Disks   []backupDisk `json:"disks"`
+}
+
+func (action *BackupAction) usage() {
+	fmt.Println("usage: qemuctl backup <machine> -target DIR [-incremental] [-keep N] [-no-freeze] [-freeze-timeout DURATION]")
+	fmt.Println("       qemuctl backup list <machine> -target DIR")
+	fmt.Println("       qemuctl backup restore <machine> -target DIR [-id BACKUP]")
+}
+
+func (action *BackupAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet
+	var subCommand string = "create"
+
+	if len(arguments) > 0 && (arguments[0] == "list" || arguments[0] == "restore") {
+		subCommand = arguments[0]
+		arguments = arguments[1:]
+	}
+
+	if len(arguments) < 1 || strings.HasPrefix(arguments[0], "-") {
+		action.usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+	action.machineName = arguments[0]
+
+	flagSet = flag.NewFlagSet("qemuctl backup", flag.ExitOnError)
+	flagSet.StringVar(&action.targetDir, "target", "", "directory holding the machine's backups")
+
+	switch subCommand {
+	case "create":
+		{
+			flagSet.BoolVar(&action.incremental, "incremental", false, "only copy what changed since the last backup")
+			flagSet.IntVar(&action.keep, "keep", 0, "number of full backup chains to keep (0 keeps everything)")
+			flagSet.DurationVar(&action.timeout, "timeout", BackupActionDefaultTimeout, "time to wait for the backup jobs")
+			flagSet.BoolVar(&action.noFreeze, "no-freeze", false, "do not freeze guest filesystems through the guest agent")
+			flagSet.DurationVar(&action.freezeTimeout, "freeze-timeout", qemuctl_qemu.QgaFsFreezeSafetyTimeout, "thaw guest filesystems after DURATION no matter what")
+		}
+	case "restore":
+		flagSet.StringVar(&action.backupID, "id", "", "backup to restore (latest if empty)")
+	}
+
+	err = flagSet.Parse(arguments[1:])
+	if err != nil {
+		return err
+	}
+
+	if len(action.targetDir) == 0 {
+		action.usage()
+		return fmt.Errorf("-target is mandatory")
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	/* Backups of each machine live in their own directory */
+	action.targetDir, err = filepath.Abs(filepath.Join(action.targetDir, machine.Name))
+	if err != nil {
+		return err
+	}
+
+	switch subCommand {
+	case "create":
+		err = action.handleBackup(machine)
+	case "list":
+		err = action.handleList()
+	case "restore":
+		err = action.handleRestore(machine)
+	}
+
+	return err
+}
+
+/* getBackups returns the machine's backups, oldest first */
+func (action *BackupAction) getBackups() (backups []backupManifest, err error) {
+	entries, err := os.ReadDir(action.targetDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		var manifest backupManifest
+
+		if !entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(action.targetDir, entry.Name(), BackupManifestFileName))
+		if err != nil {
+			/* unfinished or foreign directory */
+			log.Printf("[backup] skipping '%s': %s", entry.Name(), err.Error())
+			continue
+		}
+
+		if err = json.Unmarshal(data, &manifest); err != nil {
+			log.Printf("[backup] skipping '%s': %s", entry.Name(), err.Error())
+			continue
+		}
+
+		backups = append(backups, manifest)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ID < backups[j].ID
+	})
+
+	return backups, nil
+}
+
+func (action *BackupAction) handleBackup(machine *runtime.Machine) (err error) {
+	var manifest backupManifest
+	var targets []qemuctl_qemu.QemuBackupTarget
+	var parent *backupManifest = nil
+	var freezeErr error
+
+	images, err := getMachineImages(machine)
+	if err != nil {
+		return err
+	}
+
+	backups, err := action.getBackups()
+	if err != nil {
+		return err
+	}
+
+	manifest = backupManifest{
+		ID:      time.Now().Format(BackupIDFormat),
+		Machine: machine.Name,
+		Type:    qemuctl_qemu.QemuBackupSyncFull,
+		Created: time.Now(),
+	}
+
+	if action.incremental {
+		if !machine.IsRunning() && !machine.IsPaused() {
+			return fmt.Errorf("incremental backups need machine '%s' to be running", machine.Name)
+		}
+
+		if len(backups) == 0 {
+			return fmt.Errorf("no previous backup of '%s' in '%s'; run a full backup first", machine.Name, action.targetDir)
+		}
+
+		parent = &backups[len(backups)-1]
+		manifest.Type = qemuctl_qemu.QemuBackupSyncIncremental
+		manifest.Parent = parent.ID
+	}
+
+	backupDir := filepath.Join(action.targetDir, manifest.ID)
+	if runtime.FileExists(backupDir) {
+		return fmt.Errorf("backup '%s' already exists", backupDir)
+	}
+
+	if err = os.MkdirAll(backupDir, 0755); err != nil {
+		return err
+	}
+
+	for index, image := range images {
+		disk := backupDisk{
+			Source: image.base,
+			Format: image.baseFormat,
+			File:   fmt.Sprintf("%d-%s.qcow2", index, strings.TrimSuffix(filepath.Base(image.base), filepath.Ext(image.base))),
+		}
+
+		target := qemuctl_qemu.QemuBackupTarget{
+			Image:  image.active,
+			Target: filepath.Join(backupDir, disk.File),
+		}
+
+		if parent != nil {
+			parentDisk := findBackupDisk(parent, image.base)
+			if parentDisk == nil {
+				os.RemoveAll(backupDir)
+				return fmt.Errorf("backup '%s' has no copy of '%s'; run a full backup first", parent.ID, image.base)
+			}
+
+			/* relative, so the backup directory can be moved around */
+			target.Backing = filepath.Join("..", parent.ID, parentDisk.File)
+		}
+
+		manifest.Disks = append(manifest.Disks, disk)
+		targets = append(targets, target)
+	}
+
+	message := fmt.Sprintf("[qemuctl] %s backup of machine '%s' to '%s'...", manifest.Type, machine.Name, backupDir)
+	fmt.Print(message)
+
+	if machine.IsRunning() || machine.IsPaused() {
+		var currents map[string]int64 = make(map[string]int64)
+		var totals map[string]int64 = make(map[string]int64)
+
+		interruptCtx, stop := getInterruptContext()
+		defer stop()
+
+		ctx, cancel := context.WithTimeout(interruptCtx, action.timeout)
+		defer cancel()
+
+		qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+		freeze := getFreezeHook(qemuMonitor, !action.noFreeze, action.freezeTimeout, &freezeErr)
+		err = qemuMonitor.Backup(ctx, targets, manifest.Type, freeze, func(image string, current int64, total int64) {
+			var sumCurrent, sumTotal int64
+
+			currents[image], totals[image] = current, total
+			for key := range totals {
+				sumCurrent += currents[key]
+				sumTotal += totals[key]
+			}
+
+			if sumTotal > 0 {
+				fmt.Printf("\r%s %3d%%", message, sumCurrent*100/sumTotal)
+			}
+		})
+	} else {
+		/* Stopped machine: nothing writes to the images, copy them */
+		for index, image := range images {
+			if err = qemuctl_qemu.QemuImgConvert(image.active, image.activeFormat, targets[index].Target, qemuctl_qemu.QemuDiskFormatQcow2); err != nil {
+				break
+			}
+		}
+	}
+
+	if err == nil {
+		err = writeBackupManifest(backupDir, &manifest)
+	}
+
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		if _err := os.RemoveAll(backupDir); _err != nil {
+			log.Printf("[backup] could not remove '%s': %s", backupDir, _err.Error())
+		}
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+	printFreezeWarning(freezeErr)
+
+	if action.keep > 0 {
+		return action.pruneBackups(append(backups, manifest))
+	}
+
+	return nil
+}
+
+func findBackupDisk(manifest *backupManifest, source string) *backupDisk {
+	for index := range manifest.Disks {
+		if manifest.Disks[index].Source == source {
+			return &manifest.Disks[index]
+		}
+	}
+	return nil
+}
+
+func writeBackupManifest(backupDir string, manifest *backupManifest) (err error) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(backupDir, BackupManifestFileName), data, 0644)
+}
+
+/*
+ * pruneBackups keeps the newest 'keep' full backups along with the
+ * incremental backups built on them; anything older goes away.
+ */
+func (action *BackupAction) pruneBackups(backups []backupManifest) (err error) {
+	var fulls []int
+
+	for index, backup := range backups {
+		if backup.Type == qemuctl_qemu.QemuBackupSyncFull {
+			fulls = append(fulls, index)
+		}
+	}
+
+	if len(fulls) <= action.keep {
+		return nil
+	}
+
+	oldest := fulls[len(fulls)-action.keep]
+	for _, backup := range backups[:oldest] {
+		backupDir := filepath.Join(action.targetDir, backup.ID)
+
+		fmt.Printf("[qemuctl] pruning %s backup '%s'\n", backup.Type, backup.ID)
+		if err = os.RemoveAll(backupDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (action *BackupAction) handleList() (err error) {
+	backups, err := action.getBackups()
+	if err != nil {
+		return err
+	}
+
+	headings := fmt.Sprintf("%-18s %-12s %-18s %-20s %-6s", "ID", "TYPE", "PARENT", "CREATED", "DISKS")
+	fmt.Println(headings)
+	fmt.Printf("%s\n", strings.Repeat("-", len(headings)))
+
+	for _, backup := range backups {
+		fmt.Printf("%-18s %-12s %-18s %-20s %-6d\n",
+			backup.ID, backup.Type, runtime.GetValueOrDefault(backup.Parent, "-"),
+			backup.Created.Format("2006-01-02 15:04:05"), len(backup.Disks))
+	}
+
+	fmt.Println("")
+	return nil
+}
+
+func (action *BackupAction) handleRestore(machine *runtime.Machine) (err error) {
+	var backup *backupManifest = nil
+
+	if !machine.IsStopped() {
+		return fmt.Errorf("machine '%s' must be stopped to be restored (%s)", machine.Name, machine.Status)
+	}
+
+	/* Restoring the base images under a chain of overlays would corrupt it */
+	if len(machine.DiskChains) > 0 {
+		return fmt.Errorf("machine '%s' has external snapshots; merge them first", machine.Name)
+	}
+
+	backups, err := action.getBackups()
+	if err != nil {
+		return err
+	}
+
+	if len(backups) == 0 {
+		return fmt.Errorf("no backups of '%s' in '%s'", machine.Name, action.targetDir)
+	}
+
+	if len(action.backupID) == 0 {
+		backup = &backups[len(backups)-1]
+	} else {
+		for index := range backups {
+			if backups[index].ID == action.backupID {
+				backup = &backups[index]
+				break
+			}
+		}
+
+		if backup == nil {
+			return fmt.Errorf("backup '%s' not found in '%s'", action.backupID, action.targetDir)
+		}
+	}
+
+	for _, disk := range backup.Disks {
+		fmt.Printf("[qemuctl] restoring '%s' from backup '%s'...", disk.Source, backup.ID)
+
+		err = qemuctl_qemu.QemuImgConvert(filepath.Join(action.targetDir, backup.ID, disk.File),
+			qemuctl_qemu.QemuDiskFormatQcow2, disk.Source, disk.Format)
+		if err != nil {
+			fmt.Printf("\033[33m error!\033[0m\n")
+			return err
+		}
+
+		fmt.Printf("\033[32m ok!\033[0m\n")
+	}
+
+	/* The restored images carry no dirty bitmap */
+	fmt.Println("[qemuctl] note: the next backup of this machine must be a full one")
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	helpers "github.com/lapuglisi/qemuctl/helpers"
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type BalloonAction struct {
+	machineName string
+	timeout     time.Duration
+}
+
+func (action *BalloonAction) usage() {
+	fmt.Println("usage: qemuctl balloon <machine>")
+	fmt.Println("       qemuctl balloon <machine> set SIZE")
+}
+
+func (action *BalloonAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl balloon", flag.ExitOnError)
+
+	flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QmpDefaultTimeout, "time to wait for QEMU")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if action.machineName = flagSet.Arg(0); len(action.machineName) == 0 {
+		action.usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	switch flagSet.Arg(1) {
+	case "":
+		err = action.handleQuery(machine)
+	case "set":
+		{
+			if len(flagSet.Arg(2)) == 0 {
+				action.usage()
+				return fmt.Errorf("target size is mandatory")
+			}
+			err = action.handleSet(machine, flagSet.Arg(2))
+		}
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown balloon subcommand '%s'", flagSet.Arg(1))
+		}
+	}
+
+	return err
+}
+
+func (action *BalloonAction) handleQuery(machine *runtime.Machine) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	actual, err := qemuMonitor.QueryBalloon(ctx)
+	if err != nil {
+		return err
+	}
+
+	configHandler := helpers.NewConfigHandler(machine.ConfigFile)
+	configData, err := configHandler.ParseConfigFile()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-20s %s\n", "Configured memory:", configData.Memory)
+	fmt.Printf("%-20s %s\n", "Guest memory:", qemuctl_qemu.FormatMemorySize(actual))
+	fmt.Printf("%-20s %v\n", "Free page reporting:", configData.Balloon.FreePageReporting)
+
+	return nil
+}
+
+func (action *BalloonAction) handleSet(machine *runtime.Machine, size string) (err error) {
+	target, err := qemuctl_qemu.ParseMemorySize(size)
+	if err != nil {
+		return err
+	}
+
+	configHandler := helpers.NewConfigHandler(machine.ConfigFile)
+	configData, err := configHandler.ParseConfigFile()
+	if err != nil {
+		return err
+	}
+
+	/* The balloon can only take memory the guest was started with */
+	if maxMemory, err := qemuctl_qemu.ParseMemorySize(configData.Memory); err == nil && target > maxMemory {
+		return fmt.Errorf("target %s is above the machine's memory (%s)", size, configData.Memory)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	fmt.Printf("[qemuctl] setting memory target of machine '%s' to %s...", machine.Name, qemuctl_qemu.FormatMemorySize(target))
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	err = qemuMonitor.SetBalloon(ctx, target)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+	fmt.Println("[qemuctl] the guest gives memory back gradually; 'qemuctl balloon' shows its progress")
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type CDRomAction struct {
+	machineName string
+	isoFile     string
+	force       bool
+}
+
+func (action *CDRomAction) usage() {
+	fmt.Println("usage: qemuctl cdrom insert <machine> <iso>")
+	fmt.Println("       qemuctl cdrom eject <machine> [-force]")
+}
+
+func (action *CDRomAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet
+	var subCommand string
+
+	if len(arguments) < 2 {
+		action.usage()
+		return fmt.Errorf("subcommand and machine name are mandatory")
+	}
+
+	subCommand = arguments[0]
+	action.machineName = arguments[1]
+
+	flagSet = flag.NewFlagSet("qemuctl cdrom "+subCommand, flag.ExitOnError)
+
+	switch subCommand {
+	case "insert":
+		{
+			if len(arguments) < 3 {
+				action.usage()
+				return fmt.Errorf("ISO file is mandatory")
+			}
+
+			action.isoFile, err = filepath.Abs(arguments[2])
+			if err != nil {
+				return err
+			}
+
+			if !runtime.FileExists(action.isoFile) {
+				return fmt.Errorf("file '%s' does not exist", action.isoFile)
+			}
+		}
+	case "eject":
+		{
+			flagSet.BoolVar(&action.force, "force", false, "eject even if the guest locked the tray")
+
+			err = flagSet.Parse(arguments[2:])
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		{
+			action.usage()
+			return fmt.Errorf("unknown cdrom subcommand '%s'", subCommand)
+		}
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	if subCommand == "insert" {
+		fmt.Printf("[qemuctl] inserting '%s' in machine '%s'...", action.isoFile, machine.Name)
+		err = qemuMonitor.InsertCDRom(ctx, action.isoFile)
+	} else {
+		fmt.Printf("[qemuctl] ejecting CD-ROM of machine '%s'...", machine.Name)
+		err = qemuMonitor.EjectCDRom(ctx, action.force)
+	}
+
+	if qemuctl_qemu.IsQmpErrorClass(err, qemuctl_qemu.QmpErrorClassDeviceNotFound) {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return fmt.Errorf("machine '%s' has no CD-ROM drive (set 'disks.cdromDrive' and restart it)", machine.Name)
+	} else if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package qemuctl_actions
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	helpers "github.com/lapuglisi/qemuctl/helpers"
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	ConsoleActionEscapeChar   byte  = 0x1d /* Ctrl-] */
+	ConsoleActionTailSize     int64 = 4096
+	ConsoleActionPollInterval       = 200 * time.Millisecond
+)
+
+type ConsoleAction struct {
+	machineName string
+	readOnly    bool
+}
+
+func (action *ConsoleAction) usage() {
+	fmt.Println("usage: qemuctl console [-ro] <machine>")
+}
+
+func (action *ConsoleAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl console", flag.ExitOnError)
+
+	flagSet.BoolVar(&action.readOnly, "ro", false, "only watch the console output (any number of observers)")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if action.machineName = flagSet.Arg(0); len(action.machineName) == 0 {
+		action.usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	/* Allow flags after the machine name as well */
+	if err = flagSet.Parse(flagSet.Args()[1:]); err != nil {
+		return err
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	if !runtime.FileExists(qemuMonitor.GetSerialSocketPath()) {
+		return fmt.Errorf("machine '%s' has no serial console (serial.enabled)", machine.Name)
+	}
+
+	if action.readOnly {
+		return action.observe(qemuMonitor)
+	}
+
+	return action.attach(qemuMonitor)
+}
+
+/*
+ * attach connects the terminal to the serial socket. QEMU only serves one
+ * client, so a lock file keeps a second session from hanging on connect.
+ */
+func (action *ConsoleAction) attach(qemuMonitor *qemuctl_qemu.QemuMonitor) (err error) {
+	var inputDone chan error = make(chan error, 1)
+	var outputDone chan error = make(chan error, 1)
+
+	lockFile, err := os.OpenFile(qemuMonitor.GetSerialLockPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return fmt.Errorf("console of machine '%s' is already attached; use -ro to watch it", qemuMonitor.Machine.Name)
+	}
+
+	conn, err := net.Dial("unix", qemuMonitor.GetSerialSocketPath())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fmt.Printf("[qemuctl] connected to console of machine '%s' (escape character is ^])\n", qemuMonitor.Machine.Name)
+
+	if helpers.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := helpers.MakeRawTerminal(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer state.Restore()
+	}
+
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		outputDone <- err
+	}()
+
+	go func() {
+		var buffer []byte = make([]byte, 1024)
+
+		for {
+			count, err := os.Stdin.Read(buffer)
+			if err != nil {
+				inputDone <- err
+				return
+			}
+
+			data := buffer[:count]
+			escape := bytes.IndexByte(data, ConsoleActionEscapeChar)
+			if escape >= 0 {
+				data = data[:escape]
+			}
+
+			if _, err = conn.Write(data); err != nil {
+				inputDone <- err
+				return
+			}
+
+			if escape >= 0 {
+				inputDone <- nil
+				return
+			}
+		}
+	}()
+
+	select {
+	case err = <-inputDone:
+	case err = <-outputDone:
+	}
+
+	/* the terminal is still raw here */
+	fmt.Printf("\r\n[qemuctl] detached from console of machine '%s'\r\n", qemuMonitor.Machine.Name)
+
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+/*
+ * observe follows the console log QEMU keeps next to the socket, so any
+ * number of observers can watch without taking the socket.
+ */
+func (action *ConsoleAction) observe(qemuMonitor *qemuctl_qemu.QemuMonitor) (err error) {
+	var buffer []byte = make([]byte, 4096)
+
+	file, err := os.Open(qemuMonitor.GetSerialLogPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	/* Start with the tail for some context */
+	offset := fileInfo.Size() - ConsoleActionTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	ctx, stop := getInterruptContext()
+	defer stop()
+
+	fmt.Printf("[qemuctl] watching console of machine '%s' (Ctrl-C to stop)\n", qemuMonitor.Machine.Name)
+
+	for {
+		count, err := file.Read(buffer)
+		if count > 0 {
+			os.Stdout.Write(buffer[:count])
+			offset += int64(count)
+			continue
+		}
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		/* QEMU truncates the log when the machine starts again */
+		if fileInfo, err = file.Stat(); err == nil && fileInfo.Size() < offset {
+			if offset, err = file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-time.After(ConsoleActionPollInterval):
+		case <-ctx.Done():
+			fmt.Println()
+			return nil
+		}
+	}
+}
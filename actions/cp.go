@@ -0,0 +1,158 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type CopyAction struct {
+	timeout time.Duration
+}
+
+func (action *CopyAction) usage() {
+	fmt.Println("usage: qemuctl cp [-timeout DURATION] HOST_PATH <machine>:GUEST_PATH")
+	fmt.Println("       qemuctl cp [-timeout DURATION] <machine>:GUEST_PATH HOST_PATH")
+}
+
+/* parseGuestPath splits 'machine:/path'; host paths never have a slash before the colon */
+func parseGuestPath(spec string) (machineName string, guestPath string, ok bool) {
+	index := strings.Index(spec, ":")
+	if index <= 0 || strings.Contains(spec[:index], "/") {
+		return "", spec, false
+	}
+
+	return spec[:index], spec[index+1:], true
+}
+
+func (action *CopyAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl cp", flag.ExitOnError)
+	var machineName string
+	var guestPath string
+	var hostPath string
+	var toGuest bool
+
+	flagSet.DurationVar(&action.timeout, "timeout", 0, "give up after DURATION (0 waits forever)")
+
+	if err = flagSet.Parse(arguments); err != nil {
+		return err
+	}
+
+	if flagSet.NArg() != 2 {
+		action.usage()
+		return fmt.Errorf("source and destination are mandatory")
+	}
+
+	srcMachine, srcPath, srcGuest := parseGuestPath(flagSet.Arg(0))
+	dstMachine, dstPath, dstGuest := parseGuestPath(flagSet.Arg(1))
+
+	switch {
+	case srcGuest && !dstGuest:
+		machineName, guestPath, hostPath = srcMachine, srcPath, dstPath
+	case !srcGuest && dstGuest:
+		machineName, guestPath, hostPath, toGuest = dstMachine, dstPath, srcPath, true
+	default:
+		action.usage()
+		return fmt.Errorf("exactly one of source and destination must be <machine>:PATH")
+	}
+
+	if len(guestPath) == 0 {
+		return fmt.Errorf("guest path is mandatory")
+	}
+
+	machine := runtime.NewMachine(machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", machineName)
+	}
+
+	if !machine.IsRunning() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	ctx, stop := getInterruptContext()
+	defer stop()
+
+	if action.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, action.timeout)
+		defer cancel()
+	}
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	if toGuest {
+		return action.copyToGuest(ctx, qemuMonitor, hostPath, guestPath)
+	}
+
+	return action.copyFromGuest(ctx, qemuMonitor, guestPath, hostPath)
+}
+
+func copyProgress(message string) qemuctl_qemu.QemuJobProgress {
+	return func(current int64, total int64) {
+		if total > 0 {
+			fmt.Printf("\r%s %3d%%", message, current*100/total)
+		}
+	}
+}
+
+func (action *CopyAction) copyToGuest(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor, hostPath string, guestPath string) (err error) {
+	fileInfo, err := os.Stat(hostPath)
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.IsDir() {
+		return fmt.Errorf("'%s' is a directory; only regular files can be copied", hostPath)
+	}
+
+	if strings.HasSuffix(guestPath, "/") {
+		guestPath += filepath.Base(hostPath)
+	}
+
+	message := fmt.Sprintf("[qemuctl] copying '%s' to '%s:%s'...", hostPath, qemuMonitor.Machine.Name, guestPath)
+	fmt.Print(message)
+
+	if err = qemuMonitor.CopyToGuest(ctx, hostPath, guestPath, copyProgress(message)); err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+
+	if err = qemuMonitor.GuestChmod(ctx, guestPath, fileInfo.Mode()); err != nil {
+		fmt.Printf("[qemuctl] could not set permissions of '%s': %s\n", guestPath, err.Error())
+	}
+
+	return nil
+}
+
+func (action *CopyAction) copyFromGuest(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor, guestPath string, hostPath string) (err error) {
+	if fileInfo, err := os.Stat(hostPath); err == nil && fileInfo.IsDir() {
+		hostPath = filepath.Join(hostPath, path.Base(guestPath))
+	}
+
+	mode, err := qemuMonitor.GuestFileMode(ctx, guestPath)
+	if err != nil {
+		fmt.Printf("[qemuctl] could not read permissions of '%s', using 0644: %s\n", guestPath, err.Error())
+		mode = 0644
+	}
+
+	message := fmt.Sprintf("[qemuctl] copying '%s:%s' to '%s'...", qemuMonitor.Machine.Name, guestPath, hostPath)
+	fmt.Print(message)
+
+	if err = qemuMonitor.CopyFromGuest(ctx, guestPath, hostPath, mode, copyProgress(message)); err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+	return nil
+}
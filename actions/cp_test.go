@@ -0,0 +1,32 @@
+package qemuctl_actions
+
+import "testing"
+
+func TestParseGuestPath(t *testing.T) {
+	tests := []struct {
+		spec        string
+		wantMachine string
+		wantPath    string
+		wantOk      bool
+	}{
+		{"vm:/etc/hostname", "vm", "/etc/hostname", true},
+		{"my-vm:relative/file", "my-vm", "relative/file", true},
+		{"vm:", "vm", "", true},
+		{"vm:/path/with:colon", "vm", "/path/with:colon", true},
+		{"/local/file", "", "/local/file", false},
+		{"/local:path", "", "/local:path", false},
+		{"./a:b", "", "./a:b", false},
+		{"dir/vm:file", "", "dir/vm:file", false},
+		{":/etc/hostname", "", ":/etc/hostname", false},
+		{"plain", "", "plain", false},
+		{"", "", "", false},
+	}
+
+	for _, test := range tests {
+		machineName, guestPath, ok := parseGuestPath(test.spec)
+		if machineName != test.wantMachine || guestPath != test.wantPath || ok != test.wantOk {
+			t.Errorf("parseGuestPath(%q) = (%q, %q, %v), want (%q, %q, %v)", test.spec,
+				machineName, guestPath, ok, test.wantMachine, test.wantPath, test.wantOk)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	CPUsActionDefaultTimeout = 30 * time.Second
+)
+
+type CPUsAction struct {
+	machineName string
+	timeout     time.Duration
+}
+
+func (action *CPUsAction) usage() {
+	fmt.Println("usage: qemuctl cpus <machine>")
+	fmt.Println("       qemuctl cpus <machine> set N")
+}
+
+func (action *CPUsAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl cpus", flag.ExitOnError)
+
+	flagSet.DurationVar(&action.timeout, "timeout", CPUsActionDefaultTimeout, "time to wait for the guest to release vCPUs")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if action.machineName = flagSet.Arg(0); len(action.machineName) == 0 {
+		action.usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	switch flagSet.Arg(1) {
+	case "":
+		{
+			online, maximum, err := qemuMonitor.QueryCPUs(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("[qemuctl] machine '%s' has %d of %d vCPUs\n", machine.Name, online, maximum)
+		}
+	case "set":
+		{
+			count, _err := strconv.Atoi(flagSet.Arg(2))
+			if _err != nil || count < 1 {
+				action.usage()
+				return fmt.Errorf("invalid vCPU count '%s'", flagSet.Arg(2))
+			}
+
+			fmt.Printf("[qemuctl] setting vCPUs of machine '%s' to %d...", machine.Name, count)
+			err = qemuMonitor.SetCPUs(ctx, count)
+			if err != nil {
+				fmt.Printf("\033[33m error!\033[0m\n")
+				return err
+			}
+			fmt.Printf("\033[32m ok!\033[0m\n")
+		}
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown cpus subcommand '%s'", flagSet.Arg(1))
+		}
+	}
+
+	return err
+}
@@ -34,7 +34,7 @@ func (action *DestroyAction) Run(arguments []string) (err error) {
 		return fmt.Errorf("machine %s dos not exist", action.machineName)
 	}
 
-	if machine.IsRunning() || machine.IsStarted() {
+	if machine.IsRunning() || machine.IsStarted() || machine.IsPaused() {
 		if action.forceDestroy {
 			fmt.Printf("[qemuctl] \033[33mwarning\033[0m: force destroying machine '%s'\n", action.machineName)
 
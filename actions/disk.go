@@ -0,0 +1,181 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	helpers "github.com/lapuglisi/qemuctl/helpers"
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	DiskActionDetachTimeout = 30 * time.Second
+)
+
+type DiskAction struct {
+	machineName string
+	disk        qemuctl_qemu.QemuDisk
+	persist     bool
+	timeout     time.Duration
+}
+
+func (action *DiskAction) usage() {
+	fmt.Println("usage: qemuctl disk attach <machine> -file PATH [-format qcow2|raw] [-bus virtio|scsi] [-id ID] [-persist]")
+	fmt.Println("       qemuctl disk detach <machine> -id ID [-persist]")
+	fmt.Println("       -persist rewrites the machine's config.yaml: its comments and formatting are lost")
+}
+
+func (action *DiskAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet
+	var subCommand string
+
+	if len(arguments) < 2 {
+		action.usage()
+		return fmt.Errorf("subcommand and machine name are mandatory")
+	}
+
+	subCommand = arguments[0]
+	action.machineName = arguments[1]
+
+	flagSet = flag.NewFlagSet("qemuctl disk "+subCommand, flag.ExitOnError)
+	flagSet.StringVar(&action.disk.ID, "id", "", "device id of the disk")
+	flagSet.BoolVar(&action.persist, "persist", false, "also update 'disks.images' in the machine's config")
+
+	switch subCommand {
+	case "attach":
+		{
+			flagSet.StringVar(&action.disk.File, "file", "", "image file or host block device")
+			flagSet.StringVar(&action.disk.Format, "format", "", "image format: qcow2 or raw (guessed from the file name if empty)")
+			flagSet.StringVar(&action.disk.Bus, "bus", qemuctl_qemu.QemuDiskBusVirtio, "disk frontend: virtio or scsi")
+			flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QmpDefaultTimeout, "time to wait for QEMU")
+		}
+	case "detach":
+		{
+			flagSet.DurationVar(&action.timeout, "timeout", DiskActionDetachTimeout, "time to wait for the guest to release the disk")
+		}
+	default:
+		{
+			action.usage()
+			return fmt.Errorf("unknown disk subcommand '%s'", subCommand)
+		}
+	}
+
+	err = flagSet.Parse(arguments[2:])
+	if err != nil {
+		return err
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	if subCommand == "attach" {
+		err = action.handleAttach(machine)
+	} else {
+		err = action.handleDetach(machine)
+	}
+
+	return err
+}
+
+func (action *DiskAction) handleAttach(machine *runtime.Machine) (err error) {
+	if len(action.disk.File) == 0 {
+		action.usage()
+		return fmt.Errorf("-file is mandatory")
+	}
+
+	if action.disk.File, err = filepath.Abs(action.disk.File); err != nil {
+		return err
+	}
+
+	if len(action.disk.Format) == 0 {
+		action.disk.Format = qemuctl_qemu.QemuDiskFormatRaw
+		if strings.HasSuffix(action.disk.File, ".qcow2") {
+			action.disk.Format = qemuctl_qemu.QemuDiskFormatQcow2
+		}
+	}
+
+	if len(action.disk.ID) == 0 {
+		/* derive an id from the file name: QEMU ids must start with a letter */
+		baseName := strings.TrimSuffix(filepath.Base(action.disk.File), filepath.Ext(action.disk.File))
+		action.disk.ID = "disk-" + regexp.MustCompile(`[^A-Za-z0-9_-]`).ReplaceAllString(baseName, "_")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	fmt.Printf("[qemuctl] attaching '%s' to machine '%s' as '%s'...", action.disk.File, machine.Name, action.disk.ID)
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	err = qemuMonitor.AttachDisk(ctx, &action.disk)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+
+	if action.persist {
+		log.Printf("[disk] persisting disk '%s' to '%s'", action.disk.ID, machine.ConfigFile)
+
+		configHandler := helpers.NewConfigHandler(machine.ConfigFile)
+		err = configHandler.AppendListEntry([]string{"disks", "images"}, helpers.DiskImageConfig{
+			ID:        action.disk.ID,
+			Format:    action.disk.Format,
+			Interface: action.disk.Bus,
+			File:      action.disk.File,
+		})
+		if err != nil {
+			return fmt.Errorf("disk attached but config not updated: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (action *DiskAction) handleDetach(machine *runtime.Machine) (err error) {
+	if len(action.disk.ID) == 0 {
+		action.usage()
+		return fmt.Errorf("-id is mandatory")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	fmt.Printf("[qemuctl] detaching disk '%s' from machine '%s'...", action.disk.ID, machine.Name)
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	err = qemuMonitor.DetachDisk(ctx, action.disk.ID)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+
+	if action.persist {
+		log.Printf("[disk] removing disk '%s' from '%s'", action.disk.ID, machine.ConfigFile)
+
+		configHandler := helpers.NewConfigHandler(machine.ConfigFile)
+		removed, err := configHandler.RemoveListEntries([]string{"disks", "images"}, "id", action.disk.ID)
+		if err != nil {
+			return fmt.Errorf("disk detached but config not updated: %s", err.Error())
+		} else if removed == 0 {
+			fmt.Printf("[qemuctl] \033[33mwarning\033[0m: disk '%s' not found in config\n", action.disk.ID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type EventsAction struct {
+	machineName string
+	follow      bool
+	jsonLines   bool
+	filter      map[string]bool
+	untilEvent  string
+	timeout     time.Duration
+}
+
+func (action *EventsAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl events", flag.ExitOnError)
+	var eventNames string
+
+	flagSet.BoolVar(&action.follow, "follow", false, "keep streaming events until the machine goes away")
+	flagSet.BoolVar(&action.jsonLines, "json", false, "print events as JSON lines")
+	flagSet.StringVar(&eventNames, "event", "", "comma separated list of event names to show")
+	flagSet.StringVar(&action.untilEvent, "until", "", "exit successfully once this event is received")
+	flagSet.DurationVar(&action.timeout, "timeout", 0, "give up after this long (0 waits forever)")
+	flagSet.Usage = func() {
+		fmt.Println("usage: qemuctl events [-follow] [-json] [-event NAME[,NAME...]] [-until EVENT] [-timeout DURATION] <machine>")
+		flagSet.PrintDefaults()
+	}
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if flagSet.NArg() < 1 {
+		flagSet.Usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+	action.machineName = flagSet.Arg(0)
+
+	if len(eventNames) > 0 {
+		action.filter = make(map[string]bool)
+		for _, name := range strings.Split(eventNames, ",") {
+			action.filter[strings.ToUpper(strings.TrimSpace(name))] = true
+		}
+	}
+	action.untilEvent = strings.ToUpper(action.untilEvent)
+
+	return action.handleEvents()
+}
+
+func (action *EventsAction) handleEvents() (err error) {
+	var machine *runtime.Machine
+	var client *qemuctl_qemu.QmpClient
+	var subscription *qemuctl_qemu.QmpEventSubscription
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	machine = runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	ctx, stop := getInterruptContext()
+	defer stop()
+
+	if action.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, action.timeout)
+		defer cancel()
+	}
+
+	connectCtx, connectCancel := context.WithTimeout(ctx, qemuctl_qemu.QmpDefaultTimeout)
+	defer connectCancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	client, err = qemuMonitor.GetControlSocket(connectCtx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	subscription = client.Subscribe()
+	defer subscription.Close()
+
+	log.Printf("[events] listening for events on machine '%s'", machine.Name)
+
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			{
+				if !ok {
+					if len(action.untilEvent) > 0 {
+						return fmt.Errorf("connection closed before event '%s'", action.untilEvent)
+					}
+					return nil
+				}
+
+				/* stderr, so -json output stays parseable */
+				if dropped := subscription.Dropped(); dropped > 0 {
+					fmt.Fprintf(os.Stderr, "[qemuctl] %d event(s) dropped, output could not keep up\n", dropped)
+				}
+
+				if action.filter == nil || action.filter[event.Event] {
+					action.printEvent(event)
+
+					/* Without -follow or -until we are done after the first event */
+					if !action.follow && len(action.untilEvent) == 0 {
+						return nil
+					}
+				}
+
+				if event.Event == action.untilEvent {
+					return nil
+				}
+			}
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				return nil
+			}
+			return fmt.Errorf("no more events: %s", ctx.Err().Error())
+		}
+	}
+}
+
+func (action *EventsAction) printEvent(event *qemuctl_qemu.QmpEvent) {
+	if !action.jsonLines {
+		fmt.Println(event.String())
+		return
+	}
+
+	jsonBytes, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[events] could not marshal event %s: %s", event.Event, err.Error())
+		return
+	}
+
+	fmt.Println(string(jsonBytes))
+}
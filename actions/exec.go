@@ -0,0 +1,115 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type ExecAction struct {
+	machineName string
+	env         execEnvFlag
+	stdin       bool
+	timeout     time.Duration
+}
+
+/* execEnvFlag collects repeated --env KEY=VALUE flags */
+type execEnvFlag []string
+
+func (env *execEnvFlag) String() string {
+	return strings.Join(*env, ",")
+}
+
+func (env *execEnvFlag) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("'%s' is not KEY=VALUE", value)
+	}
+	*env = append(*env, value)
+	return nil
+}
+
+func (action *ExecAction) usage() {
+	fmt.Println("usage: qemuctl exec <machine> [--env KEY=VALUE]... [--stdin] [--timeout DURATION] -- COMMAND [ARGS...]")
+	fmt.Println("       output streams back while COMMAND runs; this needs /bin/sh in the guest")
+	fmt.Println("       on Ctrl-C or --timeout COMMAND is killed with the guest's kill(1); without one it keeps running")
+}
+
+func (action *ExecAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl exec", flag.ExitOnError)
+	var input []byte
+
+	flagSet.Var(&action.env, "env", "set KEY=VALUE in the command's environment (repeatable)")
+	flagSet.BoolVar(&action.stdin, "stdin", false, "pass qemuctl's standard input to the command")
+	flagSet.DurationVar(&action.timeout, "timeout", 0, "give up waiting for the command after DURATION (0 waits forever)")
+
+	if len(arguments) < 1 || strings.HasPrefix(arguments[0], "-") {
+		action.usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+	action.machineName = arguments[0]
+
+	if err = flagSet.Parse(arguments[1:]); err != nil {
+		return err
+	}
+
+	command := flagSet.Args()
+	if len(command) == 0 {
+		action.usage()
+		return fmt.Errorf("command is mandatory")
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	if action.stdin {
+		if input, err = io.ReadAll(os.Stdin); err != nil {
+			return fmt.Errorf("could not read standard input: %s", err.Error())
+		}
+	}
+
+	ctx, stop := getInterruptContext()
+	defer stop()
+
+	if action.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, action.timeout)
+		defer cancel()
+	}
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	status, err := qemuMonitor.GuestExecStream(ctx, command[0], command[1:], action.env, input, func(stdout []byte, stderr []byte) {
+		os.Stdout.Write(stdout)
+		os.Stderr.Write(stderr)
+	})
+	if err != nil {
+		return err
+	}
+
+	if status.OutTruncated || status.ErrTruncated {
+		fmt.Fprintf(os.Stderr, "[qemuctl] output of '%s' was truncated by the guest agent\n", command[0])
+	}
+
+	/* Mirror the shell: killed by signal N exits with 128+N */
+	if status.Signal > 0 {
+		return &ExitStatusError{Code: 128 + status.Signal}
+	}
+
+	if status.ExitCode != 0 {
+		return &ExitStatusError{Code: status.ExitCode}
+	}
+
+	return nil
+}
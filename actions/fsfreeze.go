@@ -0,0 +1,122 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type FsFreezeAction struct {
+	machineName string
+	timeout     time.Duration
+}
+
+func (action *FsFreezeAction) usage() {
+	fmt.Println("usage: qemuctl fsfreeze <machine> freeze|thaw|status [-timeout DURATION]")
+	fmt.Println("       filesystems frozen with 'freeze' stay frozen until 'thaw'")
+	fmt.Println("       backups and snapshots thaw after -freeze-timeout only while qemuctl runs; if it is killed")
+	fmt.Println("       (e.g. SIGKILL) the guest stays frozen until 'qemuctl fsfreeze <machine> thaw'")
+	fmt.Println("       'snapshot create -external' and 'backup' freeze on their own; internal snapshots do not need to")
+}
+
+func (action *FsFreezeAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl fsfreeze", flag.ExitOnError)
+
+	if len(arguments) < 2 {
+		action.usage()
+		return fmt.Errorf("machine name and fsfreeze command are mandatory")
+	}
+	action.machineName = arguments[0]
+	subCommand := arguments[1]
+
+	flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QgaDefaultTimeout, "time to wait for the guest agent")
+	if err = flagSet.Parse(arguments[2:]); err != nil {
+		return err
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	switch subCommand {
+	case "freeze":
+		{
+			fmt.Printf("[qemuctl] freezing filesystems of machine '%s'...", machine.Name)
+			count, err := qemuMonitor.GuestFsFreeze(ctx)
+			if err != nil {
+				fmt.Printf("\033[33m error!\033[0m\n")
+				return err
+			}
+			fmt.Printf("\033[32m ok!\033[0m (%d filesystems)\n", count)
+		}
+	case "thaw":
+		{
+			fmt.Printf("[qemuctl] thawing filesystems of machine '%s'...", machine.Name)
+			count, err := qemuMonitor.GuestFsThaw(ctx)
+			if err != nil {
+				fmt.Printf("\033[33m error!\033[0m\n")
+				return err
+			}
+			fmt.Printf("\033[32m ok!\033[0m (%d filesystems)\n", count)
+		}
+	case "status":
+		{
+			status, err := qemuMonitor.GuestFsFreezeStatus(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("[qemuctl] filesystems of machine '%s' are %s\n", machine.Name, status)
+		}
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown fsfreeze command '%s'", subCommand)
+		}
+	}
+
+	return err
+}
+
+/*
+ * getFreezeHook returns the hook disk operations use to freeze a running
+ * guest, or nil when there is nothing to freeze. Freeze failures do not stop
+ * the operation (the copy is then only crash-consistent); they are stored in
+ * freezeErr for the caller to report.
+ */
+func getFreezeHook(qemuMonitor *qemuctl_qemu.QemuMonitor, enabled bool, safetyTimeout time.Duration, freezeErr *error) qemuctl_qemu.QemuFreezeHook {
+	if !enabled || !qemuMonitor.Machine.IsRunning() {
+		return nil
+	}
+
+	return func() (thaw func()) {
+		ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QgaDefaultTimeout)
+		defer cancel()
+
+		thaw, err := qemuMonitor.FreezeFilesystems(ctx, safetyTimeout)
+		if err != nil {
+			*freezeErr = err
+		}
+
+		return thaw
+	}
+}
+
+func printFreezeWarning(freezeErr error) {
+	if freezeErr != nil {
+		fmt.Printf("\033[33mwarning\033[0m: could not freeze guest filesystems, image is only crash-consistent: %s\n", freezeErr.Error())
+	}
+}
@@ -1,8 +1,12 @@
 package qemuctl_actions
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"strings"
 
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
 	runtime "github.com/lapuglisi/qemuctl/runtime"
 )
 
@@ -11,6 +15,9 @@ type InfoAction struct {
 }
 
 func (action *InfoAction) Run(arguments []string) (err error) {
+	if len(arguments) < 1 {
+		return fmt.Errorf("machine name is mandatory")
+	}
 	action.machineName = arguments[0]
 
 	if len(action.machineName) == 0 {
@@ -30,7 +37,85 @@ func (action *InfoAction) Run(arguments []string) (err error) {
 	fmt.Printf("  SSH Local Port .... %d\n", machine.SSHLocalPort)
 	fmt.Printf("  Status ............ %s\n", machine.Status)
 	fmt.Printf("  Command Line ...... %s\n", machine.CommandLine)
+
+	if machine.IsRunning() || machine.IsPaused() {
+		action.printRuntimeInfo(machine)
+	}
+
 	fmt.Println("}")
 	fmt.Println("")
 	return nil
 }
+
+/* Information only a running QEMU can give */
+func (action *InfoAction) printRuntimeInfo(machine *runtime.Machine) {
+	ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	online, maximum, err := qemuMonitor.QueryCPUs(ctx)
+	if err != nil {
+		log.Printf("[info] could not query vCPUs: %s", err.Error())
+	} else {
+		fmt.Printf("  vCPUs ............. %d (max %d)\n", online, maximum)
+	}
+
+	/* Do not hang on guests without a running agent */
+	agentCtx, agentCancel := context.WithTimeout(ctx, qemuctl_qemu.QgaQuickTimeout)
+	osInfo, err := qemuMonitor.GuestOSInfo(agentCtx)
+	agentCancel()
+	if err != nil {
+		log.Printf("[info] could not query guest OS: %s", err.Error())
+	} else {
+		fmt.Printf("  Guest OS .......... %s\n", runtime.GetValueOrDefault(osInfo.PrettyName, osInfo.Name))
+		fmt.Printf("  Guest Kernel ...... %s %s\n", osInfo.KernelRelease, osInfo.KernelVersion)
+	}
+
+	addresses, forwards := getGuestNetwork(machine)
+	if len(addresses) > 0 {
+		fmt.Printf("  Guest IPs ......... %s\n", strings.Join(addresses, ", "))
+	}
+	if len(forwards) > 0 {
+		fmt.Printf("  Host Forwards ..... %s\n", strings.Join(forwards, ", "))
+	}
+
+	networkInfo, err := qemuMonitor.QueryNetworkInfo(ctx)
+	if err != nil {
+		log.Printf("[info] could not query network info: %s", err.Error())
+		return
+	}
+
+	fmt.Printf("  Network:\n")
+	for _, line := range networkInfo {
+		fmt.Printf("    %s\n", line)
+	}
+}
+
+/* getGuestNetwork returns the guest's IP addresses and the host ports forwarded to it */
+func getGuestNetwork(machine *runtime.Machine) (addresses []string, forwards []string) {
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	addresses, err := qemuMonitor.GuestIPAddresses(ctx)
+	if err != nil {
+		log.Printf("[getGuestNetwork] could not get addresses of '%s': %s", machine.Name, err.Error())
+	}
+
+	hostForwards, _, err := qemuMonitor.QueryUserNet(ctx)
+	if err != nil {
+		log.Printf("[getGuestNetwork] could not query usernet of '%s': %s", machine.Name, err.Error())
+	}
+
+	for _, forward := range hostForwards {
+		forwards = append(forwards, forward.String())
+	}
+
+	return addresses, forwards
+}
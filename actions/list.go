@@ -58,7 +58,7 @@ func (action *ListAction) Run(arguments []string) (err error) {
 		} else {
 			headings = fmt.Sprintf("%-32s %-16s %-12s", "MACHINE", "STATUS", "QEMU PID")
 			if action.showFull {
-				headings = fmt.Sprintf("%s %-16s %-16s", headings, "VNC", "SPICE")
+				headings = fmt.Sprintf("%s %-16s %-16s %-32s %-16s", headings, "VNC", "SPICE", "GUEST IPS", "FORWARDS")
 			}
 		}
 		fmt.Println(headings)
@@ -95,6 +95,9 @@ func (action *ListAction) Run(arguments []string) (err error) {
 						} else {
 							fmt.Printf("%s", strings.Repeat(" ", 16))
 						}
+
+						addresses, forwards := getGuestNetwork(machine)
+						fmt.Printf(" %-32s %s", strings.Join(addresses, ","), strings.Join(forwards, ","))
 					}
 				}
 				fmt.Println()
@@ -0,0 +1,204 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	MemoryActionDefaultTimeout = 30 * time.Second
+)
+
+type MemoryAction struct {
+	machineName string
+	model       string
+	maxSize     string
+	timeout     time.Duration
+}
+
+func (action *MemoryAction) usage() {
+	fmt.Println("usage: qemuctl memory <machine>")
+	fmt.Println("       qemuctl memory <machine> add SIZE [-model pc-dimm|virtio-mem] [-max SIZE]")
+	fmt.Println("       qemuctl memory <machine> resize ID SIZE")
+	fmt.Println("       qemuctl memory <machine> remove ID")
+}
+
+func (action *MemoryAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet
+	var subCommand string
+	var positionals []string
+
+	if len(arguments) < 1 || strings.HasPrefix(arguments[0], "-") {
+		action.usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+	action.machineName = arguments[0]
+	arguments = arguments[1:]
+
+	if len(arguments) > 0 && !strings.HasPrefix(arguments[0], "-") {
+		subCommand = arguments[0]
+		arguments = arguments[1:]
+	}
+
+	/* SIZE and ID come before the flags */
+	for len(arguments) > 0 && !strings.HasPrefix(arguments[0], "-") {
+		positionals = append(positionals, arguments[0])
+		arguments = arguments[1:]
+	}
+
+	flagSet = flag.NewFlagSet("qemuctl memory", flag.ExitOnError)
+	flagSet.StringVar(&action.model, "model", qemuctl_qemu.QemuMemoryModelDimm, "device model: pc-dimm or virtio-mem")
+	flagSet.StringVar(&action.maxSize, "max", "", "virtio-mem only: size it can be resized up to (default: all the room left below maxMemory)")
+	flagSet.DurationVar(&action.timeout, "timeout", MemoryActionDefaultTimeout, "time to wait for QEMU and the guest")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	switch subCommand {
+	case "":
+		err = action.handleList(ctx, qemuMonitor)
+	case "add":
+		{
+			if len(positionals) != 1 {
+				action.usage()
+				return fmt.Errorf("size is mandatory")
+			}
+			err = action.handleAdd(ctx, qemuMonitor, positionals[0])
+		}
+	case "resize":
+		{
+			if len(positionals) != 2 {
+				action.usage()
+				return fmt.Errorf("device id and size are mandatory")
+			}
+			err = action.handleResize(ctx, qemuMonitor, positionals[0], positionals[1])
+		}
+	case "remove":
+		{
+			if len(positionals) != 1 {
+				action.usage()
+				return fmt.Errorf("device id is mandatory")
+			}
+			err = action.handleRemove(ctx, qemuMonitor, positionals[0])
+		}
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown memory subcommand '%s'", subCommand)
+		}
+	}
+
+	return err
+}
+
+func (action *MemoryAction) handleList(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor) (err error) {
+	base, plugged, devices, err := qemuMonitor.QueryMemory(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-18s %s\n", "Boot memory:", qemuctl_qemu.FormatMemorySize(base))
+	fmt.Printf("%-18s %s\n", "Plugged memory:", qemuctl_qemu.FormatMemorySize(plugged))
+	fmt.Println("")
+
+	headings := fmt.Sprintf("%-16s %-12s %-10s %-10s %-10s", "ID", "MODEL", "SIZE", "REQUESTED", "MAX")
+	fmt.Println(headings)
+	fmt.Printf("%s\n", strings.Repeat("-", len(headings)))
+
+	for _, device := range devices {
+		requested, maximum := "-", "-"
+		if device.Model == qemuctl_qemu.QemuMemoryModelVirtioMem {
+			requested = qemuctl_qemu.FormatMemorySize(device.RequestedSize)
+			maximum = qemuctl_qemu.FormatMemorySize(device.MaxSize)
+		}
+
+		fmt.Printf("%-16s %-12s %-10s %-10s %-10s\n", device.ID, device.Model,
+			qemuctl_qemu.FormatMemorySize(device.Size), requested, maximum)
+	}
+
+	fmt.Println("")
+	return nil
+}
+
+func (action *MemoryAction) handleAdd(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor, size string) (err error) {
+	var maxBytes int64
+
+	bytes, err := qemuctl_qemu.ParseMemorySize(size)
+	if err != nil {
+		return err
+	}
+
+	if len(action.maxSize) > 0 {
+		if action.model != qemuctl_qemu.QemuMemoryModelVirtioMem {
+			return fmt.Errorf("-max only applies to virtio-mem devices")
+		}
+
+		if maxBytes, err = qemuctl_qemu.ParseMemorySize(action.maxSize); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("[qemuctl] adding %s of %s memory to machine '%s'...", qemuctl_qemu.FormatMemorySize(bytes), action.model, qemuMonitor.Machine.Name)
+
+	deviceID, err := qemuMonitor.AddMemory(ctx, action.model, bytes, maxBytes)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m (%s)\n", deviceID)
+	return nil
+}
+
+func (action *MemoryAction) handleResize(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor, deviceID string, size string) (err error) {
+	bytes, err := qemuctl_qemu.ParseMemorySize(size)
+	if err != nil && size != "0" {
+		return err
+	}
+
+	fmt.Printf("[qemuctl] resizing '%s' of machine '%s' to %s...", deviceID, qemuMonitor.Machine.Name, qemuctl_qemu.FormatMemorySize(bytes))
+
+	err = qemuMonitor.ResizeMemory(ctx, deviceID, bytes)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+	return nil
+}
+
+func (action *MemoryAction) handleRemove(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor, deviceID string) (err error) {
+	fmt.Printf("[qemuctl] removing '%s' from machine '%s'...", deviceID, qemuMonitor.Machine.Name)
+
+	err = qemuMonitor.RemoveMemory(ctx, deviceID)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+	return nil
+}
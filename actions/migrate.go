@@ -0,0 +1,253 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	helpers "github.com/lapuglisi/qemuctl/helpers"
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	MigrateActionDefaultTimeout = 30 * time.Minute
+)
+
+type MigrateAction struct {
+	sourceName      string
+	destinationName string
+	qemuBinary      string
+	postcopy        bool
+	timeout         time.Duration
+}
+
+func (action *MigrateAction) usage() {
+	fmt.Println("usage: qemuctl migrate <machine> -to <new-machine> [-qemu-binary PATH] [-postcopy] [-timeout DURATION]")
+	fmt.Println("       the new machine gets a rewritten copy of the config.yaml, without its comments")
+}
+
+func (action *MigrateAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl migrate", flag.ExitOnError)
+
+	if len(arguments) < 1 || strings.HasPrefix(arguments[0], "-") {
+		action.usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+	action.sourceName = arguments[0]
+
+	flagSet.StringVar(&action.destinationName, "to", "", "name of the machine the guest moves to")
+	flagSet.StringVar(&action.qemuBinary, "qemu-binary", "", "QEMU binary for the new machine (same as the source if empty)")
+	flagSet.BoolVar(&action.postcopy, "postcopy", false, "switch to post-copy after the first pass over guest RAM")
+	flagSet.DurationVar(&action.timeout, "timeout", MigrateActionDefaultTimeout, "time to wait for the migration")
+
+	err = flagSet.Parse(arguments[1:])
+	if err != nil {
+		return err
+	}
+
+	if len(action.destinationName) == 0 {
+		action.usage()
+		return fmt.Errorf("-to is mandatory")
+	}
+
+	source := runtime.NewMachine(action.sourceName)
+	if !source.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", source.Name)
+	}
+
+	if !source.IsRunning() && !source.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", source.Name, source.Status)
+	}
+
+	destination := runtime.NewMachine(action.destinationName)
+	if destination.Exists() {
+		return fmt.Errorf("machine '%s' already exists", destination.Name)
+	}
+
+	return action.handleMigrate(source, destination)
+}
+
+/*
+ * createDestination sets up the new machine with the source's config and
+ * launches its QEMU waiting for the guest state.
+ */
+func (action *MigrateAction) createDestination(source *runtime.Machine, destination *runtime.Machine) (configData *helpers.ConfigurationData, err error) {
+	destination.CreateRuntime()
+
+	if err = destination.UpdateConfigFile(source.ConfigFile); err != nil {
+		return nil, err
+	}
+
+	configHandler := helpers.NewConfigHandler(destination.ConfigFile)
+	if err = configHandler.SetValue([]string{"machine", "name"}, destination.Name); err != nil {
+		return nil, err
+	}
+
+	if len(action.qemuBinary) > 0 {
+		if err = configHandler.SetValue([]string{"qemuBinary"}, action.qemuBinary); err != nil {
+			return nil, err
+		}
+	}
+
+	configData, err = configHandler.ParseConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	/* Both QEMUs run side by side for a while, so nothing may listen on fixed TCP ports */
+	if !configData.RunAsDaemon {
+		return nil, fmt.Errorf("only machines with 'runAsDaemon' can be migrated")
+	}
+
+	if configData.Display.VNC.Enabled || (configData.Display.Spice.Enabled && !configData.Display.Spice.OpenGL) {
+		return nil, fmt.Errorf("machines with VNC or Spice over TCP cannot be migrated locally")
+	}
+
+	/* The overlays in use travel along with the guest */
+	for baseImage, chain := range source.DiskChains {
+		destination.DiskChains[baseImage] = append([]string{}, chain...)
+	}
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(destination)
+	qemu := qemuctl_qemu.NewQemuCommand(configData, qemuMonitor)
+	qemu.IncomingURI = qemuMonitor.GetMigrationIncomingURI()
+	qemu.NoHostForward = true
+
+	/* A paused guest must not run on the destination, not even briefly */
+	qemu.StartPaused = source.IsPaused()
+
+	destination.Reset(runtime.MachineStatusStarted)
+
+	destination.QemuPid, err = qemu.Launch()
+	if err != nil {
+		return nil, err
+	}
+	destination.UpdateData()
+
+	return configData, nil
+}
+
+func (action *MigrateAction) handleMigrate(source *runtime.Machine, destination *runtime.Machine) (err error) {
+	var sourceMonitor *qemuctl_qemu.QemuMonitor = qemuctl_qemu.NewQemuMonitor(source)
+	var destinationMonitor *qemuctl_qemu.QemuMonitor = qemuctl_qemu.NewQemuMonitor(destination)
+	var sourceWasPaused bool = source.IsPaused()
+
+	interruptCtx, stop := getInterruptContext()
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(interruptCtx, action.timeout)
+	defer cancel()
+
+	fmt.Printf("[qemuctl] creating machine '%s'...", destination.Name)
+
+	configData, err := action.createDestination(source, destination)
+	if err == nil {
+		err = destinationMonitor.PrepareIncoming(ctx, action.postcopy)
+	}
+
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		action.discardDestination(destination, destinationMonitor)
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+
+	message := fmt.Sprintf("[qemuctl] migrating machine '%s' to '%s'...", source.Name, destination.Name)
+	fmt.Print(message)
+
+	err = sourceMonitor.Migrate(ctx, destinationMonitor.GetMigrationSocketPath(), action.postcopy, func(current int64, total int64) {
+		if total > 0 {
+			fmt.Printf("\r%s %3d%%", message, current*100/total)
+		}
+	})
+
+	migrated := err == nil
+	if migrated {
+		err = destinationMonitor.FinishIncoming(ctx, !sourceWasPaused)
+	}
+
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		if action.postcopy {
+			/* Once in post-copy, neither side holds the whole guest */
+			log.Printf("[migrate] post-copy migration of '%s' failed; the guest may be lost", source.Name)
+		}
+		action.discardDestination(destination, destinationMonitor)
+
+		/* The source stopped the guest to hand it over; it still has all of it */
+		if migrated && !action.postcopy && !sourceWasPaused {
+			resumeCtx, resumeCancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+			defer resumeCancel()
+
+			if _err := sourceMonitor.Resume(resumeCtx); _err != nil {
+				log.Printf("[migrate] could not resume '%s': %s", source.Name, _err.Error())
+			}
+		}
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+
+	/* The source QEMU has nothing left to run */
+	if err = sourceMonitor.Quit(ctx); err == nil {
+		err = runtime.WaitProcessExit(ctx, source.QemuPid)
+	}
+	if err != nil {
+		log.Printf("[migrate] source QEMU of '%s' did not quit: %s", source.Name, err.Error())
+	}
+
+	source.Reset(runtime.MachineStatusStopped)
+	source.MigratedTo = destination.Name
+	source.UpdateData()
+
+	/* Port forwards can be bound now that the source let go of them */
+	if configData.Net.User.Enabled {
+		if configData.SSH.LocalPort > 0 {
+			if err = destinationMonitor.AddHostForward(ctx, configData.Net.User.ID,
+				configData.SSH.LocalPort, qemuctl_qemu.QemuHostForwardSSHGuestPort); err != nil {
+				fmt.Printf("[qemuctl] \033[33mwarning\033[0m: %s\n", err.Error())
+			}
+		}
+
+		for _, forward := range configData.Net.User.PortForwards {
+			if err = destinationMonitor.AddHostForward(ctx, configData.Net.User.ID, forward.HostPort, forward.GuestPort); err != nil {
+				fmt.Printf("[qemuctl] \033[33mwarning\033[0m: %s\n", err.Error())
+			}
+		}
+	}
+
+	destination.SSHLocalPort = configData.SSH.LocalPort
+	destination.Status = runtime.MachineStatusRunning
+	if sourceWasPaused {
+		destination.Status = runtime.MachineStatusPaused
+	}
+	destination.UpdateData()
+
+	fmt.Printf("[qemuctl] machine '%s' now runs as '%s' (pid %d)\n", source.Name, destination.Name, destination.QemuPid)
+
+	return nil
+}
+
+/* discardDestination gets rid of a destination that never got the guest */
+func (action *MigrateAction) discardDestination(destination *runtime.Machine, qemuMonitor *qemuctl_qemu.QemuMonitor) {
+	ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QemuMonitorStopGracePeriod)
+	defer cancel()
+
+	if destination.QemuPid > 0 {
+		if err := qemuMonitor.Quit(ctx); err != nil {
+			log.Printf("[migrate] could not quit '%s': %s", destination.Name, err.Error())
+		}
+
+		if runtime.WaitProcessExit(ctx, destination.QemuPid) != nil {
+			syscall.Kill(destination.QemuPid, syscall.SIGKILL)
+		}
+	}
+
+	destination.Destroy()
+}
@@ -0,0 +1,166 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	helpers "github.com/lapuglisi/qemuctl/helpers"
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	MonitorActionHistoryFile string = "monitor-history"
+)
+
+type MonitorAction struct {
+	machineName string
+	commands    []string
+	infos       []string
+}
+
+func (action *MonitorAction) Run(arguments []string) (err error) {
+	if len(arguments) < 1 {
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	if action.machineName = arguments[0]; len(action.machineName) == 0 {
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	return action.handleMonitor()
+}
+
+func (action *MonitorAction) handleMonitor() (err error) {
+	var machine *runtime.Machine
+	var client *qemuctl_qemu.QmpClient
+	var editor *helpers.LineEditor
+	var historyFile string
+
+	machine = runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	client, err = qemuMonitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	/* Build completion words from the QMP commands QEMU knows about */
+	qmpCommands, err := client.QueryCommands(ctx)
+	if err != nil {
+		log.Printf("[monitor] could not query commands: %s", err.Error())
+	}
+	action.buildCompletion(qmpCommands)
+
+	editor = helpers.NewLineEditor(fmt.Sprintf("(%s) ", machine.Name))
+	editor.Complete = action.complete
+
+	historyFile = fmt.Sprintf("%s/%s", machine.RuntimeDirectory, MonitorActionHistoryFile)
+	if err = editor.LoadHistory(historyFile); err != nil {
+		log.Printf("[monitor] could not load history: %s", err.Error())
+	}
+	defer editor.SaveHistory(historyFile)
+
+	fmt.Printf("QEMU %d.%d.%d monitor for machine '%s' - type 'help' for HMP commands, 'exit' or Ctrl-D to leave\n",
+		client.Header.QMP.Version.Qemu.Major,
+		client.Header.QMP.Version.Qemu.Minor,
+		client.Header.QMP.Version.Qemu.Micro,
+		machine.Name)
+
+	for {
+		line, err := editor.ReadLine()
+		if err == helpers.ErrLineInterrupted {
+			continue
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		editor.AddHistory(line)
+		if line == "exit" {
+			return nil
+		}
+
+		commandCtx, commandCancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+		output, err := client.HumanMonitorCommand(commandCtx, line)
+		commandCancel()
+
+		if err == qemuctl_qemu.ErrQmpClosed {
+			fmt.Println("[qemuctl] monitor connection closed")
+			return nil
+		} else if err != nil {
+			fmt.Printf("[\033[31merror\033[0m] %s\n", err.Error())
+			continue
+		}
+
+		fmt.Print(output)
+	}
+}
+
+/*
+ * HMP and QMP names mostly match: 'query-xxx' is 'info xxx' in HMP and
+ * the remaining commands use underscores instead of dashes.
+ */
+func (action *MonitorAction) buildCompletion(qmpCommands []string) {
+	var commands map[string]bool = map[string]bool{"help": true, "info": true, "exit": true}
+	var infos map[string]bool = map[string]bool{}
+
+	for _, command := range qmpCommands {
+		if strings.HasPrefix(command, "query-") {
+			infos[strings.TrimPrefix(command, "query-")] = true
+		} else if !strings.HasPrefix(command, "x-") && command != qemuctl_qemu.QmpCapabilitiesCommand {
+			commands[strings.ReplaceAll(command, "-", "_")] = true
+		}
+	}
+
+	action.commands = make([]string, 0, len(commands))
+	for command := range commands {
+		action.commands = append(action.commands, command)
+	}
+	sort.Strings(action.commands)
+
+	action.infos = make([]string, 0, len(infos))
+	for info := range infos {
+		action.infos = append(action.infos, info)
+	}
+	sort.Strings(action.infos)
+}
+
+func (action *MonitorAction) complete(line string) (candidates []string) {
+	var words []string = action.commands
+	var prefix string = ""
+	var current string = line
+
+	if strings.HasPrefix(line, "info ") {
+		words = action.infos
+		prefix = "info "
+		current = strings.TrimLeft(strings.TrimPrefix(line, "info "), " ")
+	} else if strings.Contains(line, " ") {
+		return nil
+	}
+
+	for _, word := range words {
+		if strings.HasPrefix(word, current) {
+			candidates = append(candidates, prefix+word)
+		}
+	}
+
+	return candidates
+}
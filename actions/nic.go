@@ -0,0 +1,170 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	helpers "github.com/lapuglisi/qemuctl/helpers"
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	NicActionRemoveTimeout = 30 * time.Second
+)
+
+type NicAction struct {
+	machineName string
+	nic         qemuctl_qemu.QemuNic
+	persist     bool
+	timeout     time.Duration
+}
+
+func (action *NicAction) usage() {
+	fmt.Println("usage: qemuctl nic add <machine> -id ID [-type user|bridge|tap] [-mac MAC] [-model MODEL]")
+	fmt.Println("                                [-bridge BRIDGE] [-helper PATH] [-tap IFNAME] [-persist]")
+	fmt.Println("       qemuctl nic remove <machine> -id ID [-persist]")
+	fmt.Println("       -persist rewrites the machine's config.yaml: its comments and formatting are lost")
+}
+
+func (action *NicAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet
+	var subCommand string
+
+	if len(arguments) < 2 {
+		action.usage()
+		return fmt.Errorf("subcommand and machine name are mandatory")
+	}
+
+	subCommand = arguments[0]
+	action.machineName = arguments[1]
+
+	flagSet = flag.NewFlagSet("qemuctl nic "+subCommand, flag.ExitOnError)
+	flagSet.StringVar(&action.nic.ID, "id", "", "netdev id of the interface")
+	flagSet.BoolVar(&action.persist, "persist", false, "also update 'net.bridge.interfaces' in the machine's config")
+
+	switch subCommand {
+	case "add":
+		{
+			flagSet.StringVar(&action.nic.Type, "type", qemuctl_qemu.QemuNicTypeUser, "backend type: user, bridge or tap")
+			flagSet.StringVar(&action.nic.MacAddress, "mac", "", "MAC address (generated if empty)")
+			flagSet.StringVar(&action.nic.Model, "model", qemuctl_qemu.QemuNicDefaultModel, "guest NIC model")
+			flagSet.StringVar(&action.nic.Bridge, "bridge", "", "host bridge for 'bridge' interfaces")
+			flagSet.StringVar(&action.nic.Helper, "helper", "", "bridge helper for 'bridge' interfaces")
+			flagSet.StringVar(&action.nic.TapInterface, "tap", "", "host tap interface for 'tap' interfaces")
+			flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QmpDefaultTimeout, "time to wait for QEMU")
+		}
+	case "remove":
+		{
+			flagSet.DurationVar(&action.timeout, "timeout", NicActionRemoveTimeout, "time to wait for the guest to release the interface")
+		}
+	default:
+		{
+			action.usage()
+			return fmt.Errorf("unknown nic subcommand '%s'", subCommand)
+		}
+	}
+
+	err = flagSet.Parse(arguments[2:])
+	if err != nil {
+		return err
+	}
+
+	if len(action.nic.ID) == 0 {
+		action.usage()
+		return fmt.Errorf("-id is mandatory")
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	if subCommand == "add" {
+		err = action.handleAdd(machine)
+	} else {
+		err = action.handleRemove(machine)
+	}
+
+	return err
+}
+
+func (action *NicAction) handleAdd(machine *runtime.Machine) (err error) {
+	/* Only bridge interfaces can be listed in the config; check before touching the guest */
+	if action.persist && action.nic.Type != qemuctl_qemu.QemuNicTypeBridge {
+		return fmt.Errorf("only '%s' interfaces can be persisted", qemuctl_qemu.QemuNicTypeBridge)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	fmt.Printf("[qemuctl] adding %s interface '%s' to machine '%s'...", action.nic.Type, action.nic.ID, machine.Name)
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	err = qemuMonitor.AddNic(ctx, &action.nic)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m (mac %s)\n", action.nic.MacAddress)
+
+	if action.persist {
+		log.Printf("[nic] persisting interface '%s' to '%s'", action.nic.ID, machine.ConfigFile)
+
+		configHandler := helpers.NewConfigHandler(machine.ConfigFile)
+		err = configHandler.AppendListEntry([]string{"net", "bridge", "interfaces"}, helpers.BridgeInterfaceConfig{
+			ID:         action.nic.ID,
+			Interface:  action.nic.Bridge,
+			MacAddress: action.nic.MacAddress,
+			Helper:     action.nic.Helper,
+			Model:      action.nic.Model,
+		})
+		if err == nil {
+			err = configHandler.SetValue([]string{"net", "bridge", "enabled"}, true)
+		}
+
+		if err != nil {
+			return fmt.Errorf("interface added but config not updated: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (action *NicAction) handleRemove(machine *runtime.Machine) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	fmt.Printf("[qemuctl] removing interface '%s' from machine '%s'...", action.nic.ID, machine.Name)
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	err = qemuMonitor.RemoveNic(ctx, action.nic.ID)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+
+	if action.persist {
+		log.Printf("[nic] removing interface '%s' from '%s'", action.nic.ID, machine.ConfigFile)
+
+		configHandler := helpers.NewConfigHandler(machine.ConfigFile)
+		removed, err := configHandler.RemoveListEntries([]string{"net", "bridge", "interfaces"}, "id", action.nic.ID)
+		if err != nil {
+			return fmt.Errorf("interface removed but config not updated: %s", err.Error())
+		} else if removed == 0 {
+			fmt.Printf("[qemuctl] \033[33mwarning\033[0m: interface '%s' not found in config\n", action.nic.ID)
+		}
+	}
+
+	return nil
+}
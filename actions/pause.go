@@ -0,0 +1,55 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"fmt"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type PauseAction struct {
+	machineName string
+}
+
+func (action *PauseAction) Run(arguments []string) (err error) {
+	var machine *runtime.Machine
+
+	if len(arguments) == 0 {
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	if action.machineName = arguments[0]; len(action.machineName) == 0 {
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	machine = runtime.NewMachine(action.machineName)
+
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", machine.Name)
+	}
+
+	if !machine.IsRunning() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	fmt.Printf("[qemuctl] Pausing machine '%s'...", action.machineName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+	defer cancel()
+
+	err = qemuMonitor.Pause(ctx)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	machine.Status = runtime.MachineStatusPaused
+	machine.UpdateData()
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type QmpAction struct {
+	machineName string
+	command     string
+	arguments   string
+	timeout     time.Duration
+}
+
+func (action *QmpAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl qmp", flag.ExitOnError)
+
+	flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QmpDefaultTimeout, "time to wait for QEMU's reply")
+	flagSet.Usage = func() {
+		fmt.Println("usage: qemuctl qmp [-timeout DURATION] <machine> <command> [json-arguments]")
+		flagSet.PrintDefaults()
+	}
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if flagSet.NArg() < 2 {
+		flagSet.Usage()
+		return fmt.Errorf("machine name and command are mandatory")
+	}
+
+	action.machineName = flagSet.Arg(0)
+	action.command = flagSet.Arg(1)
+	if flagSet.NArg() > 2 {
+		action.arguments = flagSet.Arg(2)
+	}
+
+	return action.handleQmp()
+}
+
+func (action *QmpAction) handleQmp() (err error) {
+	var machine *runtime.Machine
+	var client *qemuctl_qemu.QmpClient
+	var commandArgs interface{} = nil
+	var result json.RawMessage
+	var qmpError *qemuctl_qemu.QmpError
+
+	if len(action.arguments) > 0 {
+		var object map[string]interface{}
+
+		/* 'null' decodes into a nil map without error */
+		if json.Unmarshal([]byte(action.arguments), &object) != nil || object == nil {
+			return fmt.Errorf("arguments must be a valid JSON object")
+		}
+		commandArgs = json.RawMessage(action.arguments)
+	}
+
+	machine = runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	client, err = qemuMonitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	log.Printf("[qmp] executing '%s' on machine '%s'", action.command, machine.Name)
+
+	err = client.Execute(ctx, action.command, commandArgs, &result)
+
+	if errors.As(err, &qmpError) {
+		action.printJSON(map[string]interface{}{"error": qmpError})
+		return fmt.Errorf("command '%s' failed", action.command)
+	} else if err != nil {
+		return err
+	}
+
+	action.printJSON(map[string]interface{}{"return": result})
+
+	return nil
+}
+
+func (action *QmpAction) printJSON(value interface{}) {
+	jsonBytes, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Printf("[qmp] could not format reply: %s", err.Error())
+		return
+	}
+
+	fmt.Println(string(jsonBytes))
+}
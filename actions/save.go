@@ -0,0 +1,82 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	SaveActionDefaultTimeout = 10 * time.Minute
+)
+
+type SaveAction struct {
+	machineName string
+	timeout     time.Duration
+}
+
+func (action *SaveAction) Run(arguments []string) (err error) {
+	var machine *runtime.Machine
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl save", flag.ExitOnError)
+
+	flagSet.DurationVar(&action.timeout, "timeout", SaveActionDefaultTimeout, "time to wait for the state to be written")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if action.machineName = flagSet.Arg(0); len(action.machineName) == 0 {
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	machine = runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	interruptCtx, stop := getInterruptContext()
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(interruptCtx, action.timeout)
+	defer cancel()
+
+	message := fmt.Sprintf("[qemuctl] saving machine '%s'...", machine.Name)
+	fmt.Print(message)
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	paused, err := qemuMonitor.SaveState(ctx, func(current int64, total int64) {
+		if total > 0 {
+			fmt.Printf("\r%s %3d%%", message, current*100/total)
+		}
+	})
+
+	/* QEMU quits once the state is written; make sure it is gone */
+	if err == nil && machine.QemuPid > 0 {
+		err = runtime.WaitProcessExit(ctx, machine.QemuPid)
+	}
+
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	machine.QemuPid = 0
+	machine.SSHLocalPort = 0
+	machine.Status = runtime.MachineStatusSaved
+	machine.SavedPaused = paused
+	machine.UpdateData()
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+	fmt.Printf("[qemuctl] 'qemuctl start %s' resumes it\n", machine.Name)
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+type ScreenshotAction struct {
+	machineName string
+	outputFile  string
+	watch       int
+}
+
+func (action *ScreenshotAction) usage() {
+	fmt.Println("usage: qemuctl screenshot [-o FILE.png] [-watch SECONDS] <machine>")
+}
+
+func (action *ScreenshotAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl screenshot", flag.ExitOnError)
+
+	flagSet.StringVar(&action.outputFile, "o", "", "PNG file to write (<machine>-<time>.png if empty)")
+	flagSet.IntVar(&action.watch, "watch", 0, "take a screenshot every N seconds until interrupted")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if action.machineName = flagSet.Arg(0); len(action.machineName) == 0 {
+		action.usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	/* Allow flags after the machine name as well */
+	if err = flagSet.Parse(flagSet.Args()[1:]); err != nil {
+		return err
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsRunning() && !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	if action.watch <= 0 {
+		return action.takeScreenshot(qemuMonitor)
+	}
+
+	ctx, stop := getInterruptContext()
+	defer stop()
+
+	ticker := time.NewTicker(time.Duration(action.watch) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err = action.takeScreenshot(qemuMonitor); err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (action *ScreenshotAction) takeScreenshot(qemuMonitor *qemuctl_qemu.QemuMonitor) (err error) {
+	var outputFile string = action.outputFile
+
+	if len(outputFile) == 0 {
+		outputFile = fmt.Sprintf("%s-%s.png", qemuMonitor.Machine.Name, time.Now().Format("20060102-150405"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+	defer cancel()
+
+	fmt.Printf("[qemuctl] taking screenshot of machine '%s'...", qemuMonitor.Machine.Name)
+
+	data, err := qemuMonitor.Screenshot(ctx)
+	if err == nil {
+		err = os.WriteFile(outputFile, data, 0644)
+	}
+
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m (%s)\n", outputFile)
+	return nil
+}
@@ -0,0 +1,134 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	SendKeyActionDefaultHoldTime = 100 * time.Millisecond
+	TypeActionDefaultDelay       = 50 * time.Millisecond
+	TypeActionTimeout            = 10 * time.Minute
+)
+
+type SendKeyAction struct {
+	machineName string
+	holdTime    time.Duration
+}
+
+type TypeAction struct {
+	machineName string
+	delay       time.Duration
+	enter       bool
+}
+
+/* getKeyboardMachine parses '<machine> ARGS... [flags]' for sendkey and type */
+func getKeyboardMachine(flagSet *flag.FlagSet, arguments []string) (machine *runtime.Machine, positionals []string, err error) {
+	if len(arguments) < 1 || strings.HasPrefix(arguments[0], "-") {
+		return nil, nil, fmt.Errorf("machine name is mandatory")
+	}
+
+	for index := 1; index < len(arguments) && !strings.HasPrefix(arguments[index], "-"); index++ {
+		positionals = append(positionals, arguments[index])
+	}
+
+	if err = flagSet.Parse(arguments[1+len(positionals):]); err != nil {
+		return nil, nil, err
+	}
+
+	machine = runtime.NewMachine(arguments[0])
+	if !machine.Exists() {
+		return nil, nil, fmt.Errorf("machine '%s' does not exist", machine.Name)
+	}
+
+	if !machine.IsRunning() {
+		return nil, nil, fmt.Errorf("machine '%s' is not running (%s)", machine.Name, machine.Status)
+	}
+
+	return machine, positionals, nil
+}
+
+func (action *SendKeyAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl sendkey", flag.ExitOnError)
+
+	flagSet.DurationVar(&action.holdTime, "hold", SendKeyActionDefaultHoldTime, "how long keys are held down")
+
+	machine, combos, err := getKeyboardMachine(flagSet, arguments)
+	if err == nil && len(combos) == 0 {
+		err = fmt.Errorf("key combination is mandatory")
+	}
+
+	if err != nil {
+		fmt.Println("usage: qemuctl sendkey <machine> COMBO [COMBO...] [-hold DURATION]")
+		fmt.Println("       e.g. qemuctl sendkey vm ctrl-alt-delete, qemuctl sendkey vm down down enter")
+		return err
+	}
+	action.machineName = machine.Name
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	for _, combo := range combos {
+		qcodes, err := qemuctl_qemu.ParseKeyCombo(combo)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+		err = qemuMonitor.SendKeys(ctx, qcodes, action.holdTime)
+		cancel()
+
+		if err != nil {
+			return fmt.Errorf("could not send '%s': %s", combo, err.Error())
+		}
+
+		/* let the guest see separate presses */
+		time.Sleep(action.holdTime)
+	}
+
+	fmt.Printf("[qemuctl] sent %s to machine '%s'\n", strings.Join(combos, " "), machine.Name)
+	return nil
+}
+
+func (action *TypeAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl type", flag.ExitOnError)
+
+	flagSet.DurationVar(&action.delay, "delay", TypeActionDefaultDelay, "pause between characters")
+	flagSet.BoolVar(&action.enter, "enter", false, "press enter after the text")
+
+	machine, texts, err := getKeyboardMachine(flagSet, arguments)
+	if err == nil && len(texts) == 0 {
+		err = fmt.Errorf("text is mandatory")
+	}
+
+	if err != nil {
+		fmt.Println("usage: qemuctl type <machine> \"TEXT\" [-delay DURATION] [-enter]")
+		return err
+	}
+	action.machineName = machine.Name
+
+	text := strings.Join(texts, " ")
+	if action.enter {
+		text += "\n"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TypeActionTimeout)
+	defer cancel()
+
+	fmt.Printf("[qemuctl] typing %d characters on machine '%s'...", len(text), machine.Name)
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	err = qemuMonitor.TypeText(ctx, text, action.delay)
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+	return nil
+}
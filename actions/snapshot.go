@@ -0,0 +1,393 @@
+package qemuctl_actions
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	helpers "github.com/lapuglisi/qemuctl/helpers"
+	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
+	runtime "github.com/lapuglisi/qemuctl/runtime"
+)
+
+const (
+	SnapshotActionDefaultTimeout = 10 * time.Minute
+)
+
+type SnapshotAction struct {
+	machineName   string
+	snapshotName  string
+	timeout       time.Duration
+	external      bool
+	noFreeze      bool
+	freezeTimeout time.Duration
+}
+
+/* machineImage is a disk image from config and the image QEMU actually uses for it */
+type machineImage struct {
+	base         string
+	baseFormat   string
+	active       string
+	activeFormat string
+}
+
+func (action *SnapshotAction) usage() {
+	fmt.Println("usage: qemuctl snapshot create <machine> <name> [-external [-no-freeze] [-freeze-timeout DURATION]]")
+	fmt.Println("       qemuctl snapshot list <machine>")
+	fmt.Println("       qemuctl snapshot restore <machine> <name>")
+	fmt.Println("       qemuctl snapshot delete <machine> <name>")
+	fmt.Println("       qemuctl snapshot merge <machine>")
+	fmt.Println("       only -external snapshots freeze guest filesystems; internal ones keep the guest's memory")
+}
+
+func (action *SnapshotAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet
+	var subCommand string
+	var flagArgs []string
+
+	if len(arguments) < 2 {
+		action.usage()
+		return fmt.Errorf("subcommand and machine name are mandatory")
+	}
+
+	subCommand = arguments[0]
+	action.machineName = arguments[1]
+	flagArgs = arguments[2:]
+
+	if subCommand != "list" && subCommand != "merge" {
+		if len(arguments) < 3 || strings.HasPrefix(arguments[2], "-") {
+			action.usage()
+			return fmt.Errorf("snapshot name is mandatory")
+		}
+		action.snapshotName = arguments[2]
+		flagArgs = arguments[3:]
+	}
+
+	flagSet = flag.NewFlagSet("qemuctl snapshot "+subCommand, flag.ExitOnError)
+	flagSet.DurationVar(&action.timeout, "timeout", SnapshotActionDefaultTimeout, "time to wait for the snapshot job")
+	if subCommand == "create" {
+		flagSet.BoolVar(&action.external, "external", false, "create qcow2 overlays instead of internal snapshots")
+		flagSet.BoolVar(&action.noFreeze, "no-freeze", false, "do not freeze guest filesystems for external snapshots")
+		flagSet.DurationVar(&action.freezeTimeout, "freeze-timeout", qemuctl_qemu.QgaFsFreezeSafetyTimeout, "thaw guest filesystems after DURATION no matter what")
+	}
+
+	err = flagSet.Parse(flagArgs)
+	if err != nil {
+		return err
+	}
+
+	machine := runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	images, err := getMachineImages(machine)
+	if err != nil {
+		return err
+	}
+
+	switch subCommand {
+	case "create":
+		{
+			if action.external {
+				err = action.handleExternal(machine, images)
+			} else {
+				err = action.handleSnapshotJob(machine, images, qemuctl_qemu.QmpSnapshotSaveCommand, "creating")
+			}
+		}
+	case "merge":
+		err = action.handleMerge(machine, images)
+	case "restore":
+		err = action.handleSnapshotJob(machine, images, qemuctl_qemu.QmpSnapshotLoadCommand, "restoring")
+	case "delete":
+		err = action.handleSnapshotJob(machine, images, qemuctl_qemu.QmpSnapshotDeleteCommand, "deleting")
+	case "list":
+		err = action.handleList(machine, images)
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown snapshot subcommand '%s'", subCommand)
+		}
+	}
+
+	return err
+}
+
+func getMachineImages(machine *runtime.Machine) (images []machineImage, err error) {
+	configHandler := helpers.NewConfigHandler(machine.ConfigFile)
+	configData, err := configHandler.ParseConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range configData.Disks.Images {
+		imageFile, err := filepath.Abs(image.File)
+		if err != nil {
+			return nil, err
+		}
+
+		current := machineImage{
+			base:         imageFile,
+			baseFormat:   runtime.GetValueOrDefault(image.Format, qemuctl_qemu.QemuDiskFormatRaw),
+			active:       imageFile,
+			activeFormat: runtime.GetValueOrDefault(image.Format, qemuctl_qemu.QemuDiskFormatRaw),
+		}
+
+		if activeImage, isOverlay := machine.GetActiveDiskImage(imageFile); isOverlay {
+			current.active = activeImage
+			current.activeFormat = qemuctl_qemu.QemuDiskFormatQcow2
+		}
+
+		images = append(images, current)
+	}
+
+	if len(images) == 0 {
+		return nil, fmt.Errorf("machine '%s' has no disk images", machine.Name)
+	}
+
+	return images, nil
+}
+
+/* Internal snapshots are only supported by qcow2 images */
+func (action *SnapshotAction) getQcow2Images(images []machineImage) (files []string, err error) {
+	for _, image := range images {
+		if image.activeFormat == qemuctl_qemu.QemuDiskFormatQcow2 {
+			files = append(files, image.active)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("machine '%s' has no qcow2 images", action.machineName)
+	}
+
+	return files, nil
+}
+
+func (action *SnapshotAction) handleSnapshotJob(machine *runtime.Machine, allImages []machineImage, operation string, verb string) (err error) {
+	var qemuMonitor *qemuctl_qemu.QemuMonitor = qemuctl_qemu.NewQemuMonitor(machine)
+	var message string = fmt.Sprintf("[qemuctl] %s snapshot '%s' of machine '%s'...", verb, action.snapshotName, machine.Name)
+
+	images, err := action.getQcow2Images(allImages)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(message)
+
+	if machine.IsRunning() || machine.IsPaused() {
+		ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+		defer cancel()
+
+		progress := func(current int64, total int64) {
+			if total > 0 {
+				fmt.Printf("\r%s %3d%%", message, current*100/total)
+			}
+		}
+
+		switch operation {
+		case qemuctl_qemu.QmpSnapshotSaveCommand:
+			/*
+			 * Internal snapshots keep the guest's memory and need no freeze (a
+			 * restored guest would come back frozen).
+			 */
+			err = qemuMonitor.SaveSnapshot(ctx, action.snapshotName, images, progress)
+		case qemuctl_qemu.QmpSnapshotLoadCommand:
+			err = qemuMonitor.LoadSnapshot(ctx, action.snapshotName, images, progress)
+		case qemuctl_qemu.QmpSnapshotDeleteCommand:
+			err = qemuMonitor.DeleteSnapshot(ctx, action.snapshotName, images, progress)
+		}
+	} else {
+		/* Machine is not running: work on the image files */
+		for _, image := range images {
+			if err = qemuctl_qemu.QemuImgSnapshot(operation, image, action.snapshotName); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+
+	return nil
+}
+
+func (action *SnapshotAction) handleList(machine *runtime.Machine, allImages []machineImage) (err error) {
+	var snapshots []qemuctl_qemu.QemuSnapshot
+
+	images, err := action.getQcow2Images(allImages)
+	if err != nil {
+		images = nil
+	}
+
+	if machine.IsRunning() || machine.IsPaused() {
+		ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+		defer cancel()
+
+		qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+		snapshots, err = qemuMonitor.ListSnapshots(ctx, images)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, image := range images {
+			imageSnapshots, err := qemuctl_qemu.ListImageSnapshots(image)
+			if err != nil {
+				return err
+			}
+			snapshots = append(snapshots, imageSnapshots...)
+		}
+	}
+
+	headings := fmt.Sprintf("%-32s %-6s %-24s %-12s %-20s %-14s", "DISK", "ID", "TAG", "VM SIZE", "DATE", "VM CLOCK")
+	fmt.Println(headings)
+	fmt.Printf("%s\n", strings.Repeat("-", len(headings)))
+
+	for _, snapshot := range snapshots {
+		fmt.Printf("%-32s %-6s %-24s %-12s %-20s %-14s\n",
+			filepath.Base(snapshot.File), snapshot.ID, snapshot.Name, snapshot.VMStateSize,
+			snapshot.Date.Format("2006-01-02 15:04:05"), snapshot.VMClock)
+	}
+
+	/* External snapshots */
+	for _, image := range allImages {
+		chain := machine.DiskChains[image.base]
+		if len(chain) == 0 {
+			continue
+		}
+
+		fmt.Printf("\n[external overlays of '%s']\n", image.base)
+		for _, overlay := range chain {
+			fmt.Printf("  %s\n", overlay)
+		}
+	}
+
+	fmt.Println("")
+	return nil
+}
+
+func (action *SnapshotAction) handleExternal(machine *runtime.Machine, images []machineImage) (err error) {
+	var overlays map[string]string = make(map[string]string)
+	var freezeErr error
+
+	/* The name becomes part of the overlay file names */
+	if strings.ContainsRune(action.snapshotName, filepath.Separator) || strings.Contains(action.snapshotName, "..") {
+		return fmt.Errorf("invalid snapshot name '%s': external snapshot names cannot contain '%c' or '..'",
+			action.snapshotName, filepath.Separator)
+	}
+
+	for _, image := range images {
+		baseName := strings.TrimSuffix(filepath.Base(image.base), filepath.Ext(image.base))
+		overlay := filepath.Join(filepath.Dir(image.base), fmt.Sprintf("%s.%s.qcow2", baseName, action.snapshotName))
+
+		if runtime.FileExists(overlay) {
+			return fmt.Errorf("overlay '%s' already exists", overlay)
+		}
+		overlays[image.active] = overlay
+	}
+
+	fmt.Printf("[qemuctl] creating external snapshot '%s' of machine '%s'...", action.snapshotName, machine.Name)
+
+	if machine.IsRunning() || machine.IsPaused() {
+		ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+		defer cancel()
+
+		/* Overlays are disk only: freeze so they hold consistent filesystems */
+		qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+		thaw := func() {}
+		if freeze := getFreezeHook(qemuMonitor, !action.noFreeze, action.freezeTimeout, &freezeErr); freeze != nil {
+			thaw = freeze()
+		}
+		err = qemuMonitor.CreateExternalSnapshots(ctx, overlays)
+		thaw()
+	} else {
+		for _, image := range images {
+			if err = qemuctl_qemu.QemuImgCreateOverlay(image.active, image.activeFormat, overlays[image.active]); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	/* Record the new chain tops so the next start opens them */
+	for _, image := range images {
+		machine.DiskChains[image.base] = append(machine.DiskChains[image.base], overlays[image.active])
+	}
+
+	if err = machine.UpdateData(); err != nil {
+		fmt.Printf("\033[33m error!\033[0m\n")
+		return err
+	}
+
+	fmt.Printf("\033[32m ok!\033[0m\n")
+	printFreezeWarning(freezeErr)
+
+	return nil
+}
+
+func (action *SnapshotAction) handleMerge(machine *runtime.Machine, images []machineImage) (err error) {
+	var merged int = 0
+
+	for _, image := range images {
+		chain := machine.DiskChains[image.base]
+		if len(chain) == 0 {
+			continue
+		}
+
+		message := fmt.Sprintf("[qemuctl] merging %d overlay(s) into '%s'...", len(chain), image.base)
+		fmt.Print(message)
+
+		if machine.IsRunning() || machine.IsPaused() {
+			ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+
+			qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+			err = qemuMonitor.CommitExternalSnapshots(ctx, image.active, image.base, func(current int64, total int64) {
+				if total > 0 {
+					fmt.Printf("\r%s %3d%%", message, current*100/total)
+				}
+			})
+			cancel()
+		} else {
+			err = qemuctl_qemu.QemuImgCommit(image.active, image.base)
+		}
+
+		if err != nil {
+			fmt.Printf("\033[33m error!\033[0m\n")
+			return err
+		}
+
+		/* The overlays are no longer part of the chain */
+		for _, overlay := range chain {
+			if _err := os.Remove(overlay); _err != nil {
+				log.Printf("[snapshot] could not remove overlay '%s': %s", overlay, _err.Error())
+			}
+		}
+
+		delete(machine.DiskChains, image.base)
+		if err = machine.UpdateData(); err != nil {
+			fmt.Printf("\033[33m error!\033[0m\n")
+			return err
+		}
+
+		merged++
+		fmt.Printf("\033[32m ok!\033[0m\n")
+	}
+
+	if merged == 0 {
+		fmt.Printf("[qemuctl] machine '%s' has no external snapshots\n", machine.Name)
+	}
+
+	return nil
+}
@@ -1,8 +1,10 @@
 package qemuctl_actions
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
 
 	helpers "github.com/lapuglisi/qemuctl/helpers"
 	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
@@ -50,6 +52,15 @@ func (action *StartAction) handleStart(machineName string) (err error) {
 		return fmt.Errorf("[start] machine '%s' is already started", action.machine.Name)
 	}
 
+	if action.machine.IsPaused() {
+		return fmt.Errorf("[start] machine '%s' is paused; use 'resume' instead", action.machine.Name)
+	}
+
+	/* Its disks now belong to another machine */
+	if len(action.machine.MigratedTo) > 0 {
+		return fmt.Errorf("[start] machine '%s' was migrated to '%s'", action.machine.Name, action.machine.MigratedTo)
+	}
+
 	if action.machine.IsDegraded() {
 		return fmt.Errorf("[start] cannot start a degraded machine")
 	}
@@ -70,6 +81,19 @@ func (action *StartAction) handleStart(machineName string) (err error) {
 	log.Printf("[start] launching qemu command")
 	qemu := qemuctl_qemu.NewQemuCommand(configData, qemuMonitor)
 
+	/* A saved machine resumes from its state file instead of booting */
+	restoring := false
+	if action.machine.IsSaved() {
+		if runtime.FileExists(qemuMonitor.GetSavedStatePath()) {
+			log.Printf("[start] restoring machine '%s' from '%s'", action.machine.Name, qemuMonitor.GetSavedStatePath())
+			qemu.IncomingURI = qemuMonitor.GetSavedStateIncomingURI()
+			qemu.StartPaused = action.machine.SavedPaused
+			restoring = true
+		} else {
+			log.Printf("[start] saved state of '%s' is gone; booting it", action.machine.Name)
+		}
+	}
+
 	/*
 	 * Update machine status to 'started'
 	 */
@@ -83,6 +107,22 @@ func (action *StartAction) handleStart(machineName string) (err error) {
 		action.machine.SSHLocalPort = configData.SSH.LocalPort
 		action.machine.Status = runtime.MachineStatusRunning
 		action.machine.UpdateData()
+
+		if restoring {
+			err = action.finishRestore(qemuMonitor, configData.RunAsDaemon)
+		}
+
+		if restoring && err == nil {
+			/* A guest saved while paused comes back paused */
+			if action.machine.SavedPaused {
+				action.machine.Status = runtime.MachineStatusPaused
+			}
+			action.machine.SavedPaused = false
+			action.machine.UpdateData()
+		}
+	} else if restoring {
+		/* Keep the saved state around for another try */
+		action.machine.Reset(runtime.MachineStatusSaved)
 	} else {
 		// action.machine.QemuPid = 0
 		action.machine.SSHLocalPort = 0
@@ -92,3 +132,23 @@ func (action *StartAction) handleStart(machineName string) (err error) {
 
 	return err
 }
+
+/* finishRestore waits for the saved state to load and drops the state file */
+func (action *StartAction) finishRestore(qemuMonitor *qemuctl_qemu.QemuMonitor, daemonized bool) (err error) {
+	/* Without -daemonize, QEMU has already come and gone */
+	if daemonized {
+		ctx, cancel := context.WithTimeout(context.Background(), SaveActionDefaultTimeout)
+		defer cancel()
+
+		err = qemuMonitor.FinishIncoming(ctx, !action.machine.SavedPaused)
+		if err != nil {
+			return fmt.Errorf("could not restore saved state: %s", err.Error())
+		}
+	}
+
+	if err = os.Remove(qemuMonitor.GetSavedStatePath()); err != nil {
+		log.Printf("[start] could not remove saved state: %s", err.Error())
+	}
+
+	return nil
+}
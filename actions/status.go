@@ -1,6 +1,7 @@
 package qemuctl_actions
 
 import (
+	"context"
 	"fmt"
 
 	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
@@ -14,7 +15,7 @@ type StatusAction struct {
 func (action *StatusAction) Run(arguments []string) (err error) {
 	var machine *runtime.Machine
 	var qemuMonitor *qemuctl_qemu.QemuMonitor
-	var machineStatus *qemuctl_qemu.QmpQueryStatusResult
+	var machineStatus *qemuctl_qemu.QmpStatusInfo
 
 	if len(arguments) < 1 {
 		return fmt.Errorf("machine name is mandatory")
@@ -33,17 +34,29 @@ func (action *StatusAction) Run(arguments []string) (err error) {
 		return fmt.Errorf("invalid machine name")
 	}
 
-	machineStatus, err = qemuMonitor.QueryStatus()
+	ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+	defer cancel()
+
+	machineStatus, err = qemuMonitor.QueryStatus(ctx)
 	if err != nil {
 		return err
 	}
 
-	if machineStatus.Return.Running {
+	/* Keep machine data in sync with what QEMU reports */
+	if machineStatus.Running && machine.IsPaused() {
+		machine.Status = runtime.MachineStatusRunning
+		machine.UpdateData()
+	} else if machineStatus.Status == runtime.MachineStatusPaused && machine.IsRunning() {
+		machine.Status = runtime.MachineStatusPaused
+		machine.UpdateData()
+	}
+
+	if machineStatus.Running {
 		fmt.Printf("[\033[33mqemuctl\033[0m] machine '%s' is \033[32m%s\033[0m\n",
-			action.machineName, machineStatus.Return.Status)
+			action.machineName, machineStatus.Status)
 	} else {
 		fmt.Printf("[\033[33mqemuctl\033[0m] machine '%s' is \033[33m%s\033[0m\n",
-			action.machineName, machineStatus.Return.Status)
+			action.machineName, machineStatus.Status)
 	}
 
 	return nil
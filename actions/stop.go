@@ -1,7 +1,12 @@
 package qemuctl_actions
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"syscall"
+	"time"
 
 	qemuctl_qemu "github.com/lapuglisi/qemuctl/qemu"
 	runtime "github.com/lapuglisi/qemuctl/runtime"
@@ -13,16 +18,27 @@ func init() {
 
 type StopAction struct {
 	machineName string
+	timeout     time.Duration
+	escalate    bool
 }
 
 func (action *StopAction) Run(arguments []string) (err error) {
 	var machine *runtime.Machine
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl stop", flag.ExitOnError)
 
-	if len(arguments) == 0 {
+	flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QemuMonitorShutdownWait, "time to wait for the guest to power off")
+	flagSet.BoolVar(&action.escalate, "escalate", false, "use QMP 'quit', SIGTERM and SIGKILL if the guest does not power off in time")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if flagSet.NArg() == 0 {
 		return fmt.Errorf("machine name is mandatory")
 	}
 
-	if action.machineName = arguments[0]; len(action.machineName) == 0 {
+	if action.machineName = flagSet.Arg(0); len(action.machineName) == 0 {
 		return fmt.Errorf("machine name is mandatory")
 	}
 
@@ -36,13 +52,9 @@ func (action *StopAction) Run(arguments []string) (err error) {
 
 	fmt.Printf("[qemuctl] Stopping machine '%s'...", action.machineName)
 
-	err = qemuMonitor.SendShutdownCommand()
+	err = action.handleStop(machine, qemuMonitor)
 	if err != nil {
 		fmt.Printf("\033[33m error!\033[0m\n")
-		//machine.QemuPid = 0
-		machine.SSHLocalPort = 0
-		machine.Status = runtime.MachineStatusDegraded
-		machine.UpdateData()
 		return err
 	}
 
@@ -56,3 +68,124 @@ func (action *StopAction) Run(arguments []string) (err error) {
 
 	return nil
 }
+
+/*
+ * handleStop returns nil only once the QEMU process is confirmed to be gone.
+ * The guest is asked to power off first; with -escalate, QEMU is then asked
+ * to quit and finally signaled with SIGTERM and SIGKILL.
+ */
+func (action *StopAction) handleStop(machine *runtime.Machine, qemuMonitor *qemuctl_qemu.QemuMonitor) (err error) {
+	var qemuPid int = machine.QemuPid
+
+	if qemuPid <= 0 {
+		qemuPid, err = qemuMonitor.GetPidFromPidFile()
+		if err != nil {
+			return fmt.Errorf("could not find QEMU pid for machine '%s': %s", machine.Name, err.Error())
+		}
+	}
+
+	if !runtime.ProcessIsAlive(qemuPid) {
+		log.Printf("[stop] QEMU process %d is not running", qemuPid)
+		return nil
+	}
+
+	/* The pid may have been reused since QEMU wrote it */
+	if !qemuMonitor.IsQemuProcess(qemuPid) {
+		log.Printf("[stop] process %d is not QEMU for machine '%s'", qemuPid, machine.Name)
+		return nil
+	}
+
+	/* ACPI powerdown */
+	ctx, cancel := context.WithTimeout(context.Background(), action.timeout)
+	defer cancel()
+
+	if action.prepareShutdown(ctx, qemuMonitor) {
+		err = qemuMonitor.SendShutdownCommand(ctx)
+		if err == nil {
+			/* guest is shutting down: give QEMU some time to exit */
+			err = action.waitExit(qemuPid)
+		} else {
+			log.Printf("[stop] powerdown of machine '%s' failed: %s", machine.Name, err.Error())
+			if !runtime.ProcessIsAlive(qemuPid) {
+				err = nil
+			}
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if !action.escalate {
+			return fmt.Errorf("machine '%s' did not power off in %s (use -escalate to force it)",
+				machine.Name, action.timeout.String())
+		}
+	}
+
+	/* QMP quit */
+	log.Printf("[stop] sending 'quit' to machine '%s'", machine.Name)
+	quitCtx, quitCancel := context.WithTimeout(context.Background(), qemuctl_qemu.QmpDefaultTimeout)
+	defer quitCancel()
+
+	if err = qemuMonitor.Quit(quitCtx); err != nil {
+		log.Printf("[stop] 'quit' failed: %s", err.Error())
+	}
+
+	if err = action.waitExit(qemuPid); err == nil {
+		return nil
+	}
+
+	if !action.escalate {
+		return fmt.Errorf("QEMU of machine '%s' did not quit (use -escalate to force it)", machine.Name)
+	}
+
+	/* Signals */
+	for _, signal := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		if !qemuMonitor.IsQemuProcess(qemuPid) {
+			log.Printf("[stop] process %d is no longer QEMU for machine '%s'", qemuPid, machine.Name)
+			return nil
+		}
+
+		log.Printf("[stop] escalating: sending %s to QEMU process %d", signal.String(), qemuPid)
+		if err = syscall.Kill(qemuPid, signal); err != nil && err != syscall.ESRCH {
+			log.Printf("[stop] could not signal process %d: %s", qemuPid, err.Error())
+		}
+
+		if err = action.waitExit(qemuPid); err == nil {
+			return nil
+		}
+	}
+
+	machine.Status = runtime.MachineStatusDegraded
+	machine.UpdateData()
+
+	return err
+}
+
+/*
+ * prepareShutdown makes sure the guest can act on an ACPI powerdown: a
+ * paused guest is resumed, and false is returned when the guest cannot run
+ * at all (e.g. after a migration), in which case QEMU is asked to quit.
+ */
+func (action *StopAction) prepareShutdown(ctx context.Context, qemuMonitor *qemuctl_qemu.QemuMonitor) bool {
+	status, err := qemuMonitor.QueryStatus(ctx)
+	if err != nil || status.Running {
+		return true
+	}
+
+	if status.Status == qemuctl_qemu.QmpRunStatePaused {
+		if err = qemuMonitor.Resume(ctx); err == nil {
+			return true
+		}
+		log.Printf("[stop] could not resume machine '%s': %s", qemuMonitor.Machine.Name, err.Error())
+	}
+
+	log.Printf("[stop] machine '%s' is %s and cannot power off; quitting QEMU", qemuMonitor.Machine.Name, status.Status)
+	return false
+}
+
+func (action *StopAction) waitExit(qemuPid int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), qemuctl_qemu.QemuMonitorStopGracePeriod)
+	defer cancel()
+
+	return runtime.WaitProcessExit(ctx, qemuPid)
+}
@@ -30,7 +30,7 @@ func (q *QemuctlCompletion) GetCompletion(shell string) string {
 func (q *QemuctlCompletion) zshCompletion() string {
 	return `# asdasd
 function _qemuctl() {
-	local -a qemuctl_actions=(list start stop destroy create status edit);
+	local -a qemuctl_actions=(list start stop destroy create status edit qmp monitor events pause resume reset disk nic cdrom snapshot backup save migrate balloon cpus memory screenshot sendkey type agent exec cp fsfreeze console);
 	local -a qemuctl_machines=( $(qemuctl list --no-headings --names-only) );
 
 	case $CURRENT in
@@ -15,6 +15,25 @@ type portForwards struct {
 	HostPort  int `yaml:"hostPort"`
 }
 
+// DiskImageConfig is an entry of 'disks.images'. Entries with an 'id' are
+// attached with -blockdev/-device, so they can be hot-unplugged later.
+type DiskImageConfig struct {
+	ID        string `yaml:"id,omitempty"`
+	Format    string `yaml:"format"`
+	Interface string `yaml:"if,omitempty"`
+	File      string `yaml:"file"`
+	Media     string `yaml:"media,omitempty"`
+}
+
+// BridgeInterfaceConfig is an entry of 'net.bridge.interfaces'
+type BridgeInterfaceConfig struct {
+	ID         string `yaml:"id"`
+	Interface  string `yaml:"interface,omitempty"`
+	MacAddress string `yaml:"mac,omitempty"`
+	Helper     string `yaml:"helper,omitempty"`
+	Model      string `yaml:"model,omitempty"`
+}
+
 type ConfigurationData struct {
 	Machine struct {
 		EnableKVM   bool   `yaml:"enableKVM"`
@@ -41,7 +60,10 @@ type ConfigurationData struct {
 	RunAsDaemon bool   `yaml:"runAsDaemon"`
 	RunAs       string `yaml:"runAs"`
 	Memory      string `yaml:"memory"`
+	MaxMemory   string `yaml:"maxMemory"`
+	MemorySlots int64  `yaml:"slots"`
 	CPUs        int64  `yaml:"cpus"`
+	MaxCPUs     int64  `yaml:"maxCpus"`
 	PCI         struct {
 		Passthrough bool     `yaml:"passthrough"`
 		Devices     []string `yaml:"devices"`
@@ -55,13 +77,8 @@ type ConfigurationData struct {
 			PortForwards []portForwards `yaml:"portForwards"`
 		} `yaml:"user"`
 		Bridge struct {
-			Enabled    bool `yaml:"enabled"`
-			Interfaces []struct {
-				ID         string `yaml:"id"`
-				Interface  string `yaml:"interface"`
-				MacAddress string `yaml:"mac"`
-				Helper     string `yaml:"helper"`
-			} `yaml:"interfaces"`
+			Enabled    bool                    `yaml:"enabled"`
+			Interfaces []BridgeInterfaceConfig `yaml:"interfaces"`
 		} `yaml:"bridge"`
 		Tap struct {
 			Enabled      bool   `yaml:"enabled"`
@@ -80,15 +97,11 @@ type ConfigurationData struct {
 		LocalPort int `yaml:"localPort"`
 	} `yaml:"ssh"`
 	Disks struct {
-		BlockDevices []string `yaml:"blockDevices"`
-		Images       []struct {
-			Format    string `yaml:"format"`
-			Interface string `yaml:"if"`
-			File      string `yaml:"file"`
-			Media     string `yaml:"media"`
-		} `yaml:"images"`
-		ISOCDrom string `yaml:"cdrom"`
-		P9       struct {
+		BlockDevices []string          `yaml:"blockDevices"`
+		Images       []DiskImageConfig `yaml:"images"`
+		ISOCDrom     string            `yaml:"cdrom"`
+		CDRomDrive   bool              `yaml:"cdromDrive"`
+		P9           struct {
 			Source        string `yaml:"source"`
 			Tag           string `yaml:"tag"`
 			SecurityModel string `yaml:"securityModel"`
@@ -129,6 +142,16 @@ type ConfigurationData struct {
 		EnableBootMenu bool   `yaml:"enableBootMenu"`
 		BootOrder      string `yaml:"bootOrder"`
 	} `yaml:"boot"`
+	Balloon struct {
+		Enabled           bool `yaml:"enabled"`
+		FreePageReporting bool `yaml:"freePageReporting"`
+	} `yaml:"balloon"`
+	GuestAgent struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"guestAgent"`
+	Serial struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"serial"`
 	QemuBinary string `yaml:"qemuBinary"`
 }
 
@@ -221,3 +244,162 @@ func (ch *ConfigurationHandler) ParseConfigFile() (configData *ConfigurationData
 
 	return configData, nil
 }
+
+/*
+ * Config file editing. The file is handled as a generic YAML document so keys
+ * unknown to ConfigurationData and the user's key order are preserved.
+ * yaml.v2 keeps no comments, though: writing the document back drops them
+ * and reformats the file. Actions that edit the config say so in their usage.
+ */
+func (ch *ConfigurationHandler) readDocument() (document yaml.MapSlice, err error) {
+	configBytes, err := os.ReadFile(ch.filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	document = yaml.MapSlice{}
+	err = yaml.Unmarshal(configBytes, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (ch *ConfigurationHandler) writeDocument(document yaml.MapSlice) (err error) {
+	configBytes, err := yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(ch.filePath, configBytes, 0644)
+}
+
+func getDocumentValue(document yaml.MapSlice, key string) (value interface{}, ok bool) {
+	for _, item := range document {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+func setDocumentValue(document yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for index, item := range document {
+		if item.Key == key {
+			document[index].Value = value
+			return document
+		}
+	}
+
+	return append(document, yaml.MapItem{Key: key, Value: value})
+}
+
+/* updateList calls update with the list found at path, creating it if needed */
+func updateList(document yaml.MapSlice, path []string, update func([]interface{}) []interface{}) (yaml.MapSlice, error) {
+	value, ok := getDocumentValue(document, path[0])
+
+	if len(path) == 1 {
+		list, isList := value.([]interface{})
+		if ok && value != nil && !isList {
+			return nil, fmt.Errorf("'%s' is not a list", path[0])
+		}
+		return setDocumentValue(document, path[0], update(list)), nil
+	}
+
+	child, isMap := value.(yaml.MapSlice)
+	if ok && value != nil && !isMap {
+		return nil, fmt.Errorf("'%s' is not a map", path[0])
+	}
+
+	child, err := updateList(child, path[1:], update)
+	if err != nil {
+		return nil, err
+	}
+
+	return setDocumentValue(document, path[0], child), nil
+}
+
+/* setValue sets the value at path, creating the intermediate maps if needed */
+func setValue(document yaml.MapSlice, path []string, value interface{}) (yaml.MapSlice, error) {
+	if len(path) == 1 {
+		return setDocumentValue(document, path[0], value), nil
+	}
+
+	current, ok := getDocumentValue(document, path[0])
+	child, isMap := current.(yaml.MapSlice)
+	if ok && current != nil && !isMap {
+		return nil, fmt.Errorf("'%s' is not a map", path[0])
+	}
+
+	child, err := setValue(child, path[1:], value)
+	if err != nil {
+		return nil, err
+	}
+
+	return setDocumentValue(document, path[0], child), nil
+}
+
+// SetValue sets the value at path (e.g. "net", "bridge", "enabled")
+func (ch *ConfigurationHandler) SetValue(path []string, value interface{}) (err error) {
+	document, err := ch.readDocument()
+	if err != nil {
+		return err
+	}
+
+	document, err = setValue(document, path, value)
+	if err != nil {
+		return err
+	}
+
+	return ch.writeDocument(document)
+}
+
+// AppendListEntry appends entry to the list at path (e.g. "disks", "images")
+func (ch *ConfigurationHandler) AppendListEntry(path []string, entry interface{}) (err error) {
+	document, err := ch.readDocument()
+	if err != nil {
+		return err
+	}
+
+	document, err = updateList(document, path, func(list []interface{}) []interface{} {
+		return append(list, entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	return ch.writeDocument(document)
+}
+
+// RemoveListEntries removes the entries of the list at path whose 'key' equals value
+func (ch *ConfigurationHandler) RemoveListEntries(path []string, key string, value string) (removed int, err error) {
+	document, err := ch.readDocument()
+	if err != nil {
+		return 0, err
+	}
+
+	document, err = updateList(document, path, func(list []interface{}) []interface{} {
+		kept := make([]interface{}, 0, len(list))
+		for _, entry := range list {
+			if entryMap, isMap := entry.(yaml.MapSlice); isMap {
+				if entryValue, ok := getDocumentValue(entryMap, key); ok && fmt.Sprint(entryValue) == value {
+					removed++
+					continue
+				}
+			}
+			kept = append(kept, entry)
+		}
+		return kept
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if removed > 0 {
+		err = ch.writeDocument(document)
+	}
+
+	return removed, err
+}
@@ -0,0 +1,331 @@
+package qemuctl_helpers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMachineConfig string = `machine:
+  name: test
+  unknownKey: kept
+disks:
+  images:
+  - id: root
+    format: qcow2
+    file: /var/lib/vm/root.qcow2
+  - id: data
+    format: raw
+    file: /var/lib/vm/data.img
+customSection:
+  answer: 42
+net:
+  bridge:
+    enabled: false
+`
+
+func writeTestConfig(t *testing.T, contents string) (handler *ConfigurationHandler, configFile string) {
+	configFile = filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(contents), 0644); err != nil {
+		t.Fatalf("writing %s: %s", configFile, err.Error())
+	}
+
+	return NewConfigHandler(configFile), configFile
+}
+
+func readTestConfig(t *testing.T, configFile string) string {
+	configBytes, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatalf("reading %s: %s", configFile, err.Error())
+	}
+
+	return string(configBytes)
+}
+
+func TestAppendListEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		path    []string
+		entry   interface{}
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "existing list",
+			config: testMachineConfig,
+			path:   []string{"disks", "images"},
+			entry:  DiskImageConfig{ID: "scratch", Format: "qcow2", File: "/tmp/scratch.qcow2"},
+			want: `machine:
+  name: test
+  unknownKey: kept
+disks:
+  images:
+  - id: root
+    format: qcow2
+    file: /var/lib/vm/root.qcow2
+  - id: data
+    format: raw
+    file: /var/lib/vm/data.img
+  - id: scratch
+    format: qcow2
+    file: /tmp/scratch.qcow2
+customSection:
+  answer: 42
+net:
+  bridge:
+    enabled: false
+`,
+		},
+		{
+			name:   "missing list under an existing map",
+			config: testMachineConfig,
+			path:   []string{"net", "bridge", "interfaces"},
+			entry:  BridgeInterfaceConfig{ID: "net1", Interface: "br0", Model: "e1000"},
+			want: `machine:
+  name: test
+  unknownKey: kept
+disks:
+  images:
+  - id: root
+    format: qcow2
+    file: /var/lib/vm/root.qcow2
+  - id: data
+    format: raw
+    file: /var/lib/vm/data.img
+customSection:
+  answer: 42
+net:
+  bridge:
+    enabled: false
+    interfaces:
+    - id: net1
+      interface: br0
+      model: e1000
+`,
+		},
+		{
+			name:   "missing maps are created",
+			config: "machine:\n  name: test\n",
+			path:   []string{"disks", "images"},
+			entry:  DiskImageConfig{Format: "raw", File: "/dev/sdb"},
+			want: `machine:
+  name: test
+disks:
+  images:
+  - format: raw
+    file: /dev/sdb
+`,
+		},
+		{
+			name:    "path through a scalar",
+			config:  testMachineConfig,
+			path:    []string{"machine", "name", "list"},
+			entry:   "x",
+			wantErr: "'name' is not a map",
+		},
+		{
+			name:    "path ends at a map",
+			config:  testMachineConfig,
+			path:    []string{"net", "bridge"},
+			entry:   "x",
+			wantErr: "'bridge' is not a list",
+		},
+	}
+
+	for _, test := range tests {
+		handler, configFile := writeTestConfig(t, test.config)
+
+		err := handler.AppendListEntry(test.path, test.entry)
+		if len(test.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want '%s'", test.name, err, test.wantErr)
+			}
+			if got := readTestConfig(t, configFile); got != test.config {
+				t.Errorf("%s: file changed on error:\n%s", test.name, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		} else if got := readTestConfig(t, configFile); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRemoveListEntries(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		key         string
+		value       string
+		wantRemoved int
+		want        string
+	}{
+		{
+			name:        "one match",
+			config:      testMachineConfig,
+			key:         "id",
+			value:       "root",
+			wantRemoved: 1,
+			want: `machine:
+  name: test
+  unknownKey: kept
+disks:
+  images:
+  - id: data
+    format: raw
+    file: /var/lib/vm/data.img
+customSection:
+  answer: 42
+net:
+  bridge:
+    enabled: false
+`,
+		},
+		{
+			name:        "match on another key",
+			config:      testMachineConfig,
+			key:         "format",
+			value:       "qcow2",
+			wantRemoved: 1,
+			want: `machine:
+  name: test
+  unknownKey: kept
+disks:
+  images:
+  - id: data
+    format: raw
+    file: /var/lib/vm/data.img
+customSection:
+  answer: 42
+net:
+  bridge:
+    enabled: false
+`,
+		},
+		{
+			name:        "every entry",
+			config:      "disks:\n  images:\n  - file: a\n  - file: a\n",
+			key:         "file",
+			value:       "a",
+			wantRemoved: 2,
+			want:        "disks:\n  images: []\n",
+		},
+		{
+			name:        "no match leaves the file alone",
+			config:      testMachineConfig,
+			key:         "id",
+			value:       "missing",
+			wantRemoved: 0,
+			want:        testMachineConfig,
+		},
+		{
+			name:        "non string values compare as text",
+			config:      "disks:\n  images:\n  - id: 7\n  - id: \"8\"\n",
+			key:         "id",
+			value:       "7",
+			wantRemoved: 1,
+			want:        "disks:\n  images:\n  - id: \"8\"\n",
+		},
+	}
+
+	for _, test := range tests {
+		handler, configFile := writeTestConfig(t, test.config)
+
+		removed, err := handler.RemoveListEntries([]string{"disks", "images"}, test.key, test.value)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		if removed != test.wantRemoved {
+			t.Errorf("%s: removed %d entries, want %d", test.name, removed, test.wantRemoved)
+		}
+		if got := readTestConfig(t, configFile); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		path    []string
+		value   interface{}
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "existing key keeps its place",
+			config: "machine:\n  name: test\n  memory: 1G\ncustom: x\n",
+			path:   []string{"machine", "memory"},
+			value:  "2G",
+			want:   "machine:\n  name: test\n  memory: 2G\ncustom: x\n",
+		},
+		{
+			name:   "new key goes last",
+			config: "net:\n  bridge:\n    interfaces: []\ncustom: x\n",
+			path:   []string{"net", "bridge", "enabled"},
+			value:  true,
+			want:   "net:\n  bridge:\n    interfaces: []\n    enabled: true\ncustom: x\n",
+		},
+		{
+			name:   "missing maps are created",
+			config: "custom: x\n",
+			path:   []string{"net", "bridge", "enabled"},
+			value:  true,
+			want:   "custom: x\nnet:\n  bridge:\n    enabled: true\n",
+		},
+		{
+			name:   "top level key",
+			config: "qemuBinary: qemu-system-x86_64\n",
+			path:   []string{"qemuBinary"},
+			value:  "/usr/local/bin/qemu",
+			want:   "qemuBinary: /usr/local/bin/qemu\n",
+		},
+		{
+			name:    "path through a scalar",
+			config:  "net: none\n",
+			path:    []string{"net", "bridge", "enabled"},
+			value:   true,
+			wantErr: "'net' is not a map",
+		},
+	}
+
+	for _, test := range tests {
+		handler, configFile := writeTestConfig(t, test.config)
+
+		err := handler.SetValue(test.path, test.value)
+		if len(test.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want '%s'", test.name, err, test.wantErr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+		} else if got := readTestConfig(t, configFile); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestConfigEditsMissingFile(t *testing.T) {
+	handler := NewConfigHandler(filepath.Join(t.TempDir(), "missing.yaml"))
+
+	if err := handler.SetValue([]string{"a"}, 1); !os.IsNotExist(err) {
+		t.Errorf("SetValue: got %v, want a not-exist error", err)
+	}
+	if err := handler.AppendListEntry([]string{"a"}, 1); !os.IsNotExist(err) {
+		t.Errorf("AppendListEntry: got %v, want a not-exist error", err)
+	}
+	if _, err := handler.RemoveListEntries([]string{"a"}, "id", "x"); !os.IsNotExist(err) {
+		t.Errorf("RemoveListEntries: got %v, want a not-exist error", err)
+	}
+}
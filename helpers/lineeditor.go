@@ -0,0 +1,319 @@
+package qemuctl_helpers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	LineEditorHistoryLimit int = 500
+)
+
+var ErrLineInterrupted = errors.New("interrupted")
+
+// LineEditor is a tiny readline: line editing, history and tab completion
+type LineEditor struct {
+	Prompt   string
+	Complete func(line string) []string
+
+	input   *os.File
+	output  *os.File
+	reader  *bufio.Reader
+	history []string
+
+	/* current line state */
+	line        []rune
+	cursor      int
+	historyPos  int
+	historySave []rune
+}
+
+func NewLineEditor(prompt string) *LineEditor {
+	return &LineEditor{
+		Prompt:  prompt,
+		input:   os.Stdin,
+		output:  os.Stdout,
+		reader:  bufio.NewReader(os.Stdin),
+		history: make([]string, 0),
+	}
+}
+
+func (editor *LineEditor) AddHistory(line string) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	if count := len(editor.history); count > 0 && editor.history[count-1] == line {
+		return
+	}
+
+	editor.history = append(editor.history, line)
+	if len(editor.history) > LineEditorHistoryLimit {
+		editor.history = editor.history[len(editor.history)-LineEditorHistoryLimit:]
+	}
+}
+
+func (editor *LineEditor) LoadHistory(filePath string) (err error) {
+	fileData, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(fileData), "\n") {
+		editor.AddHistory(line)
+	}
+
+	return nil
+}
+
+func (editor *LineEditor) SaveHistory(filePath string) (err error) {
+	return os.WriteFile(filePath, []byte(strings.Join(editor.history, "\n")+"\n"), 0600)
+}
+
+/*
+ * ReadLine prints the prompt and returns the line typed by the user. It returns
+ * io.EOF on Ctrl-D over an empty line and ErrLineInterrupted on Ctrl-C. When
+ * stdin is not a terminal, lines are read as they come, with no editing.
+ */
+func (editor *LineEditor) ReadLine() (line string, err error) {
+	var state *TerminalState
+
+	if !IsTerminal(int(editor.input.Fd())) {
+		line, err = editor.reader.ReadString('\n')
+		if err != nil && len(line) > 0 {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	state, err = MakeRawTerminal(int(editor.input.Fd()))
+	if err != nil {
+		return "", err
+	}
+	defer state.Restore()
+
+	editor.line = make([]rune, 0)
+	editor.cursor = 0
+	editor.historyPos = len(editor.history)
+	editor.historySave = nil
+
+	editor.refresh()
+
+	for {
+		key, _, err := editor.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch key {
+		case '\r', '\n':
+			{
+				fmt.Fprint(editor.output, "\r\n")
+				return string(editor.line), nil
+			}
+		case 0x01: // Ctrl-A
+			editor.cursor = 0
+		case 0x02: // Ctrl-B
+			editor.moveCursor(-1)
+		case 0x03: // Ctrl-C
+			{
+				fmt.Fprint(editor.output, "^C\r\n")
+				return "", ErrLineInterrupted
+			}
+		case 0x04: // Ctrl-D
+			{
+				if len(editor.line) == 0 {
+					fmt.Fprint(editor.output, "\r\n")
+					return "", io.EOF
+				}
+				editor.deleteAt(editor.cursor)
+			}
+		case 0x05: // Ctrl-E
+			editor.cursor = len(editor.line)
+		case 0x06: // Ctrl-F
+			editor.moveCursor(1)
+		case 0x08, 0x7f: // Backspace
+			{
+				if editor.cursor > 0 {
+					editor.cursor--
+					editor.deleteAt(editor.cursor)
+				}
+			}
+		case '\t':
+			editor.complete()
+		case 0x0b: // Ctrl-K
+			editor.line = editor.line[:editor.cursor]
+		case 0x0c: // Ctrl-L
+			fmt.Fprint(editor.output, "\033[H\033[2J")
+		case 0x0e: // Ctrl-N
+			editor.moveHistory(1)
+		case 0x10: // Ctrl-P
+			editor.moveHistory(-1)
+		case 0x15: // Ctrl-U
+			{
+				editor.line = editor.line[editor.cursor:]
+				editor.cursor = 0
+			}
+		case 0x17: // Ctrl-W
+			editor.deleteWord()
+		case 0x1b: // Escape sequences
+			editor.handleEscape()
+		default:
+			{
+				if key >= ' ' {
+					editor.insert(key)
+				}
+			}
+		}
+
+		editor.refresh()
+	}
+}
+
+func (editor *LineEditor) handleEscape() {
+	var sequence []rune = make([]rune, 0)
+
+	first, _, err := editor.reader.ReadRune()
+	if err != nil || (first != '[' && first != 'O') {
+		return
+	}
+
+	/* Read until the final byte of the CSI sequence */
+	for {
+		key, _, err := editor.reader.ReadRune()
+		if err != nil {
+			return
+		}
+		sequence = append(sequence, key)
+		if key >= 0x40 && key <= 0x7e {
+			break
+		}
+	}
+
+	switch string(sequence) {
+	case "A":
+		editor.moveHistory(-1)
+	case "B":
+		editor.moveHistory(1)
+	case "C":
+		editor.moveCursor(1)
+	case "D":
+		editor.moveCursor(-1)
+	case "H", "1~", "7~":
+		editor.cursor = 0
+	case "F", "4~", "8~":
+		editor.cursor = len(editor.line)
+	case "3~":
+		editor.deleteAt(editor.cursor)
+	}
+}
+
+func (editor *LineEditor) refresh() {
+	fmt.Fprintf(editor.output, "\r\033[K%s%s", editor.Prompt, string(editor.line))
+	if back := len(editor.line) - editor.cursor; back > 0 {
+		fmt.Fprintf(editor.output, "\033[%dD", back)
+	}
+}
+
+func (editor *LineEditor) insert(key rune) {
+	editor.line = append(editor.line, 0)
+	copy(editor.line[editor.cursor+1:], editor.line[editor.cursor:])
+	editor.line[editor.cursor] = key
+	editor.cursor++
+}
+
+func (editor *LineEditor) deleteAt(position int) {
+	if position < 0 || position >= len(editor.line) {
+		return
+	}
+
+	editor.line = append(editor.line[:position], editor.line[position+1:]...)
+}
+
+func (editor *LineEditor) deleteWord() {
+	start := editor.cursor
+	for start > 0 && editor.line[start-1] == ' ' {
+		start--
+	}
+	for start > 0 && editor.line[start-1] != ' ' {
+		start--
+	}
+
+	editor.line = append(editor.line[:start], editor.line[editor.cursor:]...)
+	editor.cursor = start
+}
+
+func (editor *LineEditor) moveCursor(delta int) {
+	editor.cursor += delta
+
+	if editor.cursor < 0 {
+		editor.cursor = 0
+	} else if editor.cursor > len(editor.line) {
+		editor.cursor = len(editor.line)
+	}
+}
+
+func (editor *LineEditor) moveHistory(delta int) {
+	position := editor.historyPos + delta
+	if position < 0 || position > len(editor.history) {
+		return
+	}
+
+	/* Keep what was being typed before browsing the history */
+	if editor.historyPos == len(editor.history) {
+		editor.historySave = editor.line
+	}
+
+	editor.historyPos = position
+	if position == len(editor.history) {
+		editor.line = editor.historySave
+	} else {
+		editor.line = []rune(editor.history[position])
+	}
+	editor.cursor = len(editor.line)
+}
+
+func (editor *LineEditor) complete() {
+	if editor.Complete == nil {
+		return
+	}
+
+	prefix := string(editor.line[:editor.cursor])
+	candidates := editor.Complete(prefix)
+	if len(candidates) == 0 {
+		return
+	}
+
+	sort.Strings(candidates)
+	common := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, common) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	if len(candidates) == 1 {
+		common += " "
+	}
+
+	if len(common) > len(prefix) {
+		suffix := editor.line[editor.cursor:]
+		editor.line = append([]rune(common), suffix...)
+		editor.cursor = len([]rune(common))
+		return
+	}
+
+	/* Nothing more to complete: show the choices */
+	fmt.Fprint(editor.output, "\r\n")
+	for _, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		fmt.Fprintf(editor.output, "%s  ", fields[len(fields)-1])
+	}
+	fmt.Fprint(editor.output, "\r\n")
+}
@@ -0,0 +1,74 @@
+package qemuctl_helpers
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// TerminalState holds the termios settings of a terminal before it was put in raw mode
+type TerminalState struct {
+	fd      int
+	termios syscall.Termios
+}
+
+func getTermios(fd int) (termios *syscall.Termios, err error) {
+	termios = &syscall.Termios{}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(syscall.TCGETS), uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return nil, errno
+	}
+
+	return termios, nil
+}
+
+func setTermios(fd int, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(syscall.TCSETS), uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func IsTerminal(fd int) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
+
+/*
+ * MakeRawTerminal puts the terminal referred by fd in raw mode (no echo,
+ * no line buffering, no signals) and returns its previous state.
+ */
+func MakeRawTerminal(fd int) (state *TerminalState, err error) {
+	termios, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	state = &TerminalState{
+		fd:      fd,
+		termios: *termios,
+	}
+
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	termios.Cflag |= syscall.CS8
+	termios.Cc[syscall.VMIN] = 1
+	termios.Cc[syscall.VTIME] = 0
+
+	if err = setTermios(fd, termios); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (state *TerminalState) Restore() error {
+	return setTermios(state.fd, &state.termios)
+}
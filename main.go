@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -49,6 +50,12 @@ func main() {
 	appAction := actions.GetActionInterface(action)
 	err = appAction.Run(execArgs)
 
+	/* Actions like exec report their own status */
+	var exitErr *actions.ExitStatusError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.Code)
+	}
+
 	if err != nil {
 		fmt.Printf("[\033[31merror\033[0m] %s\n", err.Error())
 	}
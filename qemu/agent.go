@@ -0,0 +1,400 @@
+package qemuctl_qemu
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	QemuGuestAgentSocketFileName string = "qga.sock"
+	QemuGuestAgentChardevID      string = "qemuctl-qga0"
+	QemuGuestAgentChannelName    string = "org.qemu.guest_agent.0"
+	QemuVirtioSerialID           string = "qemuctl-virtio-serial0"
+	QemuGuestAgentSentinel       byte   = 0xFF
+
+	QgaSyncDelimitedCommand        string = "guest-sync-delimited"
+	QgaPingCommand                 string = "guest-ping"
+	QgaInfoCommand                 string = "guest-info"
+	QgaGetOSInfoCommand            string = "guest-get-osinfo"
+	QgaNetworkGetInterfacesCommand string = "guest-network-get-interfaces"
+	QgaExecCommand                 string = "guest-exec"
+	QgaExecStatusCommand           string = "guest-exec-status"
+	QgaDefaultTimeout                     = 5 * time.Second
+	QgaQuickTimeout                       = 2 * time.Second
+	QgaExecPollInterval                   = 100 * time.Millisecond
+	QgaExecMaxPollInterval                = time.Second
+)
+
+/*
+ * QgaClient talks to the QEMU guest agent. Unlike QMP there is no greeting
+ * and no events: one reply per command. The agent may have stale output
+ * from a previous client, which the guest-sync-delimited handshake flushes.
+ */
+type QgaClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+}
+
+type qgaResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *QmpError       `json:"error"`
+}
+
+type QgaInfo struct {
+	Version           string `json:"version"`
+	SupportedCommands []struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+	} `json:"supported_commands"`
+}
+
+type QgaOSInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	PrettyName    string `json:"pretty-name"`
+	Version       string `json:"version"`
+	VersionID     string `json:"version-id"`
+	KernelRelease string `json:"kernel-release"`
+	KernelVersion string `json:"kernel-version"`
+	Machine       string `json:"machine"`
+}
+
+type QgaIPAddress struct {
+	Type    string `json:"ip-address-type"`
+	Address string `json:"ip-address"`
+	Prefix  int    `json:"prefix"`
+}
+
+type QgaNetworkInterface struct {
+	Name            string         `json:"name"`
+	HardwareAddress string         `json:"hardware-address"`
+	IPAddresses     []QgaIPAddress `json:"ip-addresses"`
+}
+
+type QgaExecStatus struct {
+	Exited       bool   `json:"exited"`
+	ExitCode     int    `json:"exitcode"`
+	Signal       int    `json:"signal"`
+	OutData      string `json:"out-data"`
+	ErrData      string `json:"err-data"`
+	OutTruncated bool   `json:"out-truncated"`
+	ErrTruncated bool   `json:"err-truncated"`
+}
+
+/* QgaExecOutput receives whatever stdout/stderr the agent handed back */
+type QgaExecOutput func(stdout []byte, stderr []byte)
+
+func (monitor *QemuMonitor) GetGuestAgentSocketPath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuGuestAgentSocketFileName)
+}
+
+/* QEMU arguments for the agent channel: chardev, virtio-serial controller and port */
+func (monitor *QemuMonitor) GetGuestAgentChardevSpec() string {
+	return fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off", QemuGuestAgentChardevID, monitor.GetGuestAgentSocketPath())
+}
+
+func GetVirtioSerialDeviceSpec() string {
+	return fmt.Sprintf("virtio-serial-pci,id=%s", QemuVirtioSerialID)
+}
+
+func GetGuestAgentPortSpec() string {
+	return fmt.Sprintf("virtserialport,chardev=%s,name=%s", QemuGuestAgentChardevID, QemuGuestAgentChannelName)
+}
+
+func NewQgaClient(ctx context.Context, conn net.Conn) (client *QgaClient, err error) {
+	client = &QgaClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	if err = client.sync(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("guest agent is not responding: %s", err.Error())
+	}
+
+	return client, nil
+}
+
+func (client *QgaClient) setDeadline(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(QgaDefaultTimeout)
+	}
+	client.conn.SetDeadline(deadline)
+}
+
+/* sync resets the agent's parser and skips whatever it had queued for us */
+func (client *QgaClient) sync(ctx context.Context) (err error) {
+	var syncID int64 = time.Now().UnixNano() & 0x7fffffff
+	var result int64
+
+	client.setDeadline(ctx)
+
+	request, err := json.Marshal(map[string]interface{}{
+		"execute":   QgaSyncDelimitedCommand,
+		"arguments": map[string]int64{"id": syncID},
+	})
+	if err != nil {
+		return err
+	}
+
+	/* a lone 0xFF makes the agent drop any partial command */
+	if _, err = client.conn.Write(append([]byte{QemuGuestAgentSentinel}, append(request, '\n')...)); err != nil {
+		return err
+	}
+
+	/* The reply to guest-sync-delimited starts with 0xFF */
+	if _, err = client.reader.ReadBytes(QemuGuestAgentSentinel); err != nil {
+		return err
+	}
+
+	for {
+		line, err := client.reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+
+		var response qgaResponse
+		if json.Unmarshal(line, &response) != nil || response.Error != nil {
+			continue
+		}
+
+		if json.Unmarshal(response.Return, &result) == nil && result == syncID {
+			log.Printf("[QgaClient] synced with guest agent (id %d)", syncID)
+			return nil
+		}
+	}
+}
+
+func (client *QgaClient) Execute(ctx context.Context, command string, arguments interface{}, result interface{}) (err error) {
+	var response qgaResponse
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	request := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	client.setDeadline(ctx)
+
+	log.Printf("[QgaClient] executing '%s'", command)
+	if _, err = client.conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	line, err := client.reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(line, &response); err != nil {
+		return fmt.Errorf("invalid guest agent reply: %s", err.Error())
+	}
+
+	if response.Error != nil {
+		return response.Error
+	}
+
+	if result != nil && len(response.Return) > 0 {
+		return json.Unmarshal(response.Return, result)
+	}
+
+	return nil
+}
+
+func (client *QgaClient) Close() error {
+	return client.conn.Close()
+}
+
+/* GetGuestAgent connects and syncs with the machine's guest agent */
+func (monitor *QemuMonitor) GetGuestAgent(ctx context.Context) (client *QgaClient, err error) {
+	var dialer net.Dialer
+	var socketPath string = monitor.GetGuestAgentSocketPath()
+
+	if _, err = os.Stat(socketPath); err != nil {
+		return nil, fmt.Errorf("machine '%s' has no guest agent channel (guestAgent.enabled)", monitor.Machine.Name)
+	}
+
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewQgaClient(ctx, conn)
+}
+
+/* executeAgentCommand runs a single agent command on a fresh connection */
+func (monitor *QemuMonitor) executeAgentCommand(ctx context.Context, command string, arguments interface{}, result interface{}) (err error) {
+	client, err := monitor.GetGuestAgent(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Execute(ctx, command, arguments, result)
+}
+
+func (monitor *QemuMonitor) GuestPing(ctx context.Context) error {
+	return monitor.executeAgentCommand(ctx, QgaPingCommand, nil, nil)
+}
+
+func (monitor *QemuMonitor) GuestInfo(ctx context.Context) (info *QgaInfo, err error) {
+	info = &QgaInfo{}
+	if err = monitor.executeAgentCommand(ctx, QgaInfoCommand, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (monitor *QemuMonitor) GuestOSInfo(ctx context.Context) (info *QgaOSInfo, err error) {
+	info = &QgaOSInfo{}
+	if err = monitor.executeAgentCommand(ctx, QgaGetOSInfoCommand, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (monitor *QemuMonitor) GuestNetworkInterfaces(ctx context.Context) (interfaces []QgaNetworkInterface, err error) {
+	err = monitor.executeAgentCommand(ctx, QgaNetworkGetInterfacesCommand, nil, &interfaces)
+	return interfaces, err
+}
+
+/*
+ * GuestExec runs path inside the guest and polls guest-exec-status until it
+ * exits, passing output along as the agent returns it. Note that most agent
+ * versions only hand out the captured output once the process has exited.
+ * If ctx ends first, the process is killed with killGuestProcess.
+ */
+func (monitor *QemuMonitor) GuestExec(ctx context.Context, path string, args []string, env []string, input []byte, output QgaExecOutput) (status *QgaExecStatus, err error) {
+	var interval time.Duration = QgaExecPollInterval
+
+	client, err := monitor.GetGuestAgent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	pid, err := startGuestExec(ctx, client, path, args, env, input)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[GuestExec] '%s' started in machine '%s' with pid %d", path, monitor.Machine.Name, pid)
+
+	for {
+		status = &QgaExecStatus{}
+		err = client.Execute(ctx, QgaExecStatusCommand, map[string]int{"pid": pid}, status)
+		if err != nil {
+			if ctx.Err() != nil {
+				client.Close()
+				monitor.killGuestProcess(pid)
+			}
+			return nil, err
+		}
+
+		if err = passExecOutput(status, output); err != nil {
+			return nil, err
+		}
+
+		if status.Exited {
+			log.Printf("[GuestExec] pid %d exited (code %d, signal %d)", pid, status.ExitCode, status.Signal)
+			return status, nil
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			{
+				/* The agent serves one client at a time */
+				client.Close()
+				monitor.killGuestProcess(pid)
+				return nil, ctx.Err()
+			}
+		}
+
+		/* back off for long running commands */
+		if interval < QgaExecMaxPollInterval {
+			interval *= 2
+		}
+	}
+}
+
+/* startGuestExec starts path with guest-exec, capturing its output */
+func startGuestExec(ctx context.Context, client *QgaClient, path string, args []string, env []string, input []byte) (pid int, err error) {
+	var execResult struct {
+		PID int `json:"pid"`
+	}
+
+	arguments := map[string]interface{}{
+		"path":           path,
+		"capture-output": true,
+	}
+	if len(args) > 0 {
+		arguments["arg"] = args
+	}
+	if len(env) > 0 {
+		arguments["env"] = env
+	}
+	if len(input) > 0 {
+		arguments["input-data"] = base64.StdEncoding.EncodeToString(input)
+	}
+
+	if err = client.Execute(ctx, QgaExecCommand, arguments, &execResult); err != nil {
+		return 0, err
+	}
+
+	return execResult.PID, nil
+}
+
+/* passExecOutput hands the output captured in status to output, if any */
+func passExecOutput(status *QgaExecStatus, output QgaExecOutput) (err error) {
+	stdout, err := base64.StdEncoding.DecodeString(status.OutData)
+	if err != nil {
+		return fmt.Errorf("invalid stdout from guest agent: %s", err.Error())
+	}
+	stderr, err := base64.StdEncoding.DecodeString(status.ErrData)
+	if err != nil {
+		return fmt.Errorf("invalid stderr from guest agent: %s", err.Error())
+	}
+
+	if (len(stdout) > 0 || len(stderr) > 0) && output != nil {
+		output(stdout, stderr)
+	}
+
+	return nil
+}
+
+/*
+ * killGuestProcess kills a process started by GuestExec that we stopped
+ * waiting for. The agent has no command for that, so it runs the guest's
+ * kill(1); guests without one (e.g. Windows) keep the process running.
+ */
+func (monitor *QemuMonitor) killGuestProcess(pid int) {
+	ctx, cancel := context.WithTimeout(context.Background(), QgaDefaultTimeout)
+	defer cancel()
+
+	log.Printf("[killGuestProcess] killing pid %d in machine '%s'", pid, monitor.Machine.Name)
+	err := monitor.executeAgentCommand(ctx, QgaExecCommand, map[string]interface{}{
+		"path": "kill",
+		"arg":  []string{"-KILL", strconv.Itoa(pid)},
+	}, nil)
+	if err != nil {
+		log.Printf("[killGuestProcess] could not kill pid %d: %s", pid, err.Error())
+	}
+}
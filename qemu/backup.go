@@ -0,0 +1,204 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	QmpBlockdevBackupCommand         string = "blockdev-backup"
+	QmpBlockDirtyBitmapAddCommand    string = "block-dirty-bitmap-add"
+	QmpBlockDirtyBitmapClearCommand  string = "block-dirty-bitmap-clear"
+	QmpBlockDirtyBitmapRemoveCommand string = "block-dirty-bitmap-remove"
+	QemuBackupBitmapName             string = "qemuctl-backup"
+	QemuBackupNodePrefix             string = "qemuctl-backup"
+	QemuBackupSyncFull               string = "full"
+	QemuBackupSyncIncremental        string = "incremental"
+	QemuBackupJobPrefix              string = "qemuctl-backup-job"
+)
+
+/*
+ * QemuBackupTarget is one disk to back up: Image is the file QEMU has open,
+ * Target the qcow2 file to write. Incremental targets are overlays of the
+ * previous backup (Backing), so only dirty clusters are written to them.
+ */
+type QemuBackupTarget struct {
+	Image   string
+	Target  string
+	Backing string
+}
+
+// QemuBackupProgress reports the job progress of one target image
+type QemuBackupProgress func(image string, current int64, total int64)
+
+func bitmapExists(node *qmpNamedBlockNode, name string) bool {
+	for _, bitmap := range node.DirtyBitmaps {
+		if bitmap.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Backup runs blockdev-backup for every target at the same point in time.
+ * Full backups (re)start the persistent dirty bitmap of each disk, so the
+ * next incremental backup only copies what changed since then.
+ */
+func (monitor *QemuMonitor) Backup(ctx context.Context, targets []QemuBackupTarget, sync string, freeze QemuFreezeHook, progress QemuBackupProgress) (err error) {
+	var client *QmpClient
+	var actions []interface{}
+	var sourceNodes []string
+	var targetNodes []string
+	var jobIDs []string
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	/* Whatever happens, do not leave the target nodes open */
+	defer func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), QmpDefaultTimeout)
+		defer cancel()
+
+		for _, targetNode := range targetNodes {
+			if _err := client.Execute(cleanupCtx, QmpBlockdevDelCommand, map[string]string{"node-name": targetNode}, nil); _err != nil {
+				log.Printf("[Backup] could not remove target node '%s': %s", targetNode, _err.Error())
+			}
+		}
+	}()
+
+	for index, target := range targets {
+		node, err := monitor.findFormatNode(ctx, client, target.Image)
+		if err != nil {
+			return err
+		}
+
+		hasBitmap := bitmapExists(node, QemuBackupBitmapName)
+		if sync == QemuBackupSyncIncremental && !hasBitmap {
+			return fmt.Errorf("'%s' has no backup bitmap; run a full backup first", target.Image)
+		}
+
+		if len(target.Backing) > 0 {
+			err = QemuImgCreateOverlay(target.Backing, QemuDiskFormatQcow2, target.Target)
+		} else {
+			err = QemuImgCreate(target.Target, QemuDiskFormatQcow2, node.Image.VirtualSize)
+		}
+		if err == nil {
+			/* qemu-img ran as root, QEMU opens the target as 'runAs' */
+			err = monitor.ChownToRunAs(target.Target)
+		}
+		if err != nil {
+			return err
+		}
+
+		targetNode := fmt.Sprintf("%s-%d", QemuBackupNodePrefix, index)
+		log.Printf("[Backup] opening target '%s' as '%s'", target.Target, targetNode)
+		err = client.Execute(ctx, QmpBlockdevAddCommand, map[string]interface{}{
+			"driver":    QemuDiskFormatQcow2,
+			"node-name": targetNode,
+			"file": map[string]string{
+				"driver":   "file",
+				"filename": target.Target,
+			},
+		}, nil)
+		if err != nil {
+			return err
+		}
+		targetNodes = append(targetNodes, targetNode)
+		sourceNodes = append(sourceNodes, node.NodeName)
+
+		bitmapArguments := map[string]interface{}{
+			"node": node.NodeName,
+			"name": QemuBackupBitmapName,
+		}
+
+		/* Without auto-dismiss, WaitJob gets to see a failed job's error */
+		backupArguments := map[string]interface{}{
+			"job-id":       fmt.Sprintf("%s-%d-%d", QemuBackupJobPrefix, index, time.Now().Unix()),
+			"device":       node.NodeName,
+			"target":       targetNode,
+			"sync":         sync,
+			"auto-dismiss": false,
+		}
+		jobIDs = append(jobIDs, backupArguments["job-id"].(string))
+
+		if sync == QemuBackupSyncIncremental {
+			backupArguments["bitmap"] = QemuBackupBitmapName
+		} else if hasBitmap {
+			actions = append(actions, map[string]interface{}{"type": QmpBlockDirtyBitmapClearCommand, "data": bitmapArguments})
+		} else if node.Driver == QemuDiskFormatQcow2 {
+			/* Persistent bitmaps survive restarts, but need a qcow2 image */
+			bitmapArguments["persistent"] = true
+			actions = append(actions, map[string]interface{}{"type": QmpBlockDirtyBitmapAddCommand, "data": bitmapArguments})
+		}
+
+		actions = append(actions, map[string]interface{}{"type": QmpBlockdevBackupCommand, "data": backupArguments})
+	}
+
+	/* The transaction picks the point in time; the guest only needs to be frozen for it */
+	thaw := func() {}
+	if freeze != nil {
+		thaw = freeze()
+	}
+
+	log.Printf("[Backup] starting %s backup of %d disk(s)", sync, len(targets))
+	err = client.Execute(ctx, QmpTransactionCommand, map[string]interface{}{"actions": actions}, nil)
+	thaw()
+	if err != nil {
+		return err
+	}
+
+	for index, jobID := range jobIDs {
+		image := targets[index].Image
+		err = monitor.WaitJob(ctx, client, jobID, func(current int64, total int64) {
+			if progress != nil {
+				progress(image, current, total)
+			}
+		})
+
+		if err != nil {
+			/* Jobs left running would keep their target nodes busy */
+			for _, pendingID := range jobIDs[index:] {
+				monitor.cancelJob(client, pendingID)
+			}
+			break
+		}
+	}
+
+	/*
+	 * A failed incremental job leaves its bitmap untouched, but a failed full
+	 * backup already cleared it: drop it so no incremental builds on top.
+	 */
+	if err != nil && sync == QemuBackupSyncFull {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), QmpDefaultTimeout)
+		defer cancel()
+
+		for _, sourceNode := range sourceNodes {
+			_err := client.Execute(cleanupCtx, QmpBlockDirtyBitmapRemoveCommand, map[string]string{
+				"node": sourceNode,
+				"name": QemuBackupBitmapName,
+			}, nil)
+			if _err != nil {
+				log.Printf("[Backup] could not remove bitmap of '%s': %s", sourceNode, _err.Error())
+			}
+		}
+	}
+
+	return err
+}
+
+func QemuImgCreate(file string, format string, size int64) (err error) {
+	_, err = runQemuImg("create", "-f", format, file, strconv.FormatInt(size, 10))
+	return err
+}
+
+func QemuImgConvert(source string, sourceFormat string, target string, targetFormat string) (err error) {
+	_, err = runQemuImg("convert", "-f", sourceFormat, "-O", targetFormat, source, target)
+	return err
+}
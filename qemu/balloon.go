@@ -0,0 +1,104 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	QemuBalloonDeviceID string = "qemuctl-balloon0"
+
+	QmpQueryBalloonCommand string = "query-balloon"
+	QmpBalloonCommand      string = "balloon"
+)
+
+type qmpBalloonInfo struct {
+	Actual int64 `json:"actual"`
+}
+
+func GetBalloonDeviceSpec(freePageReporting bool) string {
+	spec := fmt.Sprintf("virtio-balloon-pci,id=%s", QemuBalloonDeviceID)
+	if freePageReporting {
+		spec = spec + ",free-page-reporting=on"
+	}
+	return spec
+}
+
+/*
+ * ParseMemorySize converts a QEMU memory size ("1024", "512M", "4G") to
+ * bytes. Like '-m', plain numbers are megabytes.
+ */
+func ParseMemorySize(size string) (bytes int64, err error) {
+	var multiplier int64 = 1 << 20
+	var multipliers map[string]int64 = map[string]int64{
+		"B": 1,
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+		"T": 1 << 40,
+	}
+
+	number := strings.TrimSpace(size)
+	if len(number) == 0 {
+		return 0, fmt.Errorf("empty memory size")
+	}
+
+	if value, ok := multipliers[strings.ToUpper(number[len(number)-1:])]; ok {
+		multiplier = value
+		number = number[:len(number)-1]
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid memory size '%s'", size)
+	}
+
+	/* "inf" parses as a float too; neither fits in an int64 */
+	if value*float64(multiplier) >= math.MaxInt64 {
+		return 0, fmt.Errorf("memory size '%s' is too large", size)
+	}
+
+	return int64(value * float64(multiplier)), nil
+}
+
+func FormatMemorySize(bytes int64) string {
+	switch {
+	case bytes >= 1<<30 && bytes%(1<<30) == 0:
+		return fmt.Sprintf("%dG", bytes>>30)
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.2fG", float64(bytes)/float64(1<<30))
+	default:
+		return fmt.Sprintf("%dM", bytes>>20)
+	}
+}
+
+/* QueryBalloon returns the memory the guest currently has, in bytes */
+func (monitor *QemuMonitor) QueryBalloon(ctx context.Context) (actual int64, err error) {
+	var info qmpBalloonInfo
+
+	err = monitor.ExecuteCommand(ctx, QmpQueryBalloonCommand, nil, &info)
+	if err != nil {
+		if IsQmpErrorClass(err, QmpErrorClassDeviceNotActive) {
+			return 0, fmt.Errorf("machine '%s' has no balloon device", monitor.Machine.Name)
+		}
+		return 0, err
+	}
+
+	return info.Actual, nil
+}
+
+/* SetBalloon asks the guest to give memory back (or take it) until it has target bytes */
+func (monitor *QemuMonitor) SetBalloon(ctx context.Context, target int64) (err error) {
+	log.Printf("[SetBalloon] setting balloon target of '%s' to %d bytes", monitor.Machine.Name, target)
+
+	err = monitor.ExecuteCommand(ctx, QmpBalloonCommand, map[string]int64{"value": target}, nil)
+	if IsQmpErrorClass(err, QmpErrorClassDeviceNotActive) {
+		return fmt.Errorf("machine '%s' has no balloon device", monitor.Machine.Name)
+	}
+
+	return err
+}
@@ -0,0 +1,66 @@
+package qemuctl_qemu
+
+import "testing"
+
+func TestParseMemorySize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{size: "1024", want: 1 << 30},
+		{size: "512M", want: 512 << 20},
+		{size: "512m", want: 512 << 20},
+		{size: "4G", want: 4 << 30},
+		{size: "1.5G", want: 3 << 29},
+		{size: "64K", want: 64 << 10},
+		{size: "1T", want: 1 << 40},
+		{size: "4096B", want: 4096},
+		{size: " 2G ", want: 2 << 30},
+		{size: "", wantErr: true},
+		{size: "G", wantErr: true},
+		{size: "0", wantErr: true},
+		{size: "-1G", wantErr: true},
+		{size: "2GB", wantErr: true},
+		{size: "lots", wantErr: true},
+		{size: "inf", wantErr: true},
+		{size: "9000000T", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseMemorySize(test.size)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseMemorySize(%q) = %d, want an error", test.size, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseMemorySize(%q): %s", test.size, err.Error())
+		} else if got != test.want {
+			t.Errorf("ParseMemorySize(%q) = %d, want %d", test.size, got, test.want)
+		}
+	}
+}
+
+func TestFormatMemorySize(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		want  string
+	}{
+		{0, "0M"},
+		{512 << 20, "512M"},
+		{1023 << 20, "1023M"},
+		{1 << 30, "1G"},
+		{8 << 30, "8G"},
+		{3 << 29, "1.50G"},
+		{(2 << 30) + (256 << 20), "2.25G"},
+	}
+
+	for _, test := range tests {
+		if got := FormatMemorySize(test.bytes); got != test.want {
+			t.Errorf("FormatMemorySize(%d) = '%s', want '%s'", test.bytes, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+const (
+	QemuCDRomDeviceID string = "qemuctl-cdrom0"
+	QemuCDRomDriveID  string = QemuCDRomDeviceID + QemuDiskNodeSuffix
+
+	QmpBlockdevChangeMediumCommand string = "blockdev-change-medium"
+	QmpEjectCommand                string = "eject"
+)
+
+/*
+ * The CD-ROM is an ide-cd device with a fixed id, so its media can be
+ * changed later through QMP. An empty drive is created when file is empty.
+ */
+func GetCDRomDriveSpec(file string) string {
+	spec := fmt.Sprintf("if=none,id=%s,media=cdrom,readonly=on", QemuCDRomDriveID)
+	if len(file) > 0 {
+		spec = fmt.Sprintf("%s,format=raw,file=%s", spec, EscapeOptionValue(file))
+	}
+
+	return spec
+}
+
+/*
+ * Firmware that honours bootindex (OVMF, for one) ignores '-boot order' for
+ * a CD-ROM set up with -device, so bootFirst gives it the first bootindex.
+ */
+func GetCDRomDeviceSpec(bootFirst bool) string {
+	spec := fmt.Sprintf("ide-cd,id=%s,drive=%s", QemuCDRomDeviceID, QemuCDRomDriveID)
+	if bootFirst {
+		spec += ",bootindex=0"
+	}
+
+	return spec
+}
+
+func (monitor *QemuMonitor) InsertCDRom(ctx context.Context, file string) error {
+	arguments := map[string]string{
+		"id":             QemuCDRomDeviceID,
+		"filename":       file,
+		"format":         "raw",
+		"read-only-mode": "read-only",
+	}
+
+	log.Printf("[InsertCDRom] inserting '%s' in machine '%s'", file, monitor.Machine.Name)
+	return monitor.ExecuteCommand(ctx, QmpBlockdevChangeMediumCommand, arguments, nil)
+}
+
+func (monitor *QemuMonitor) EjectCDRom(ctx context.Context, force bool) error {
+	arguments := map[string]interface{}{
+		"id":    QemuCDRomDeviceID,
+		"force": force,
+	}
+
+	log.Printf("[EjectCDRom] ejecting CD-ROM of machine '%s' (force: %v)", monitor.Machine.Name, force)
+	return monitor.ExecuteCommand(ctx, QmpEjectCommand, arguments, nil)
+}
@@ -0,0 +1,35 @@
+package qemuctl_qemu
+
+import (
+	"fmt"
+)
+
+const (
+	QemuSerialSocketFileName string = "console.sock"
+	QemuSerialLogFileName    string = "console.log"
+	QemuSerialLockFileName   string = "console.lock"
+	QemuSerialChardevID      string = "qemuctl-serial0"
+)
+
+func (monitor *QemuMonitor) GetSerialSocketPath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuSerialSocketFileName)
+}
+
+/* Everything the guest writes on the serial port also goes to this file */
+func (monitor *QemuMonitor) GetSerialLogPath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuSerialLogFileName)
+}
+
+/* Held by the interactive console session; QEMU serves one socket client at a time */
+func (monitor *QemuMonitor) GetSerialLockPath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuSerialLockFileName)
+}
+
+func (monitor *QemuMonitor) GetSerialChardevSpec() string {
+	return fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off,logfile=%s",
+		QemuSerialChardevID, monitor.GetSerialSocketPath(), monitor.GetSerialLogPath())
+}
+
+func GetSerialSpec() string {
+	return fmt.Sprintf("chardev:%s", QemuSerialChardevID)
+}
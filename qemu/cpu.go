@@ -0,0 +1,157 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	QemuCPUDevicePrefix string = "qemuctl-cpu"
+
+	QmpQueryHotpluggableCPUsCommand string = "query-hotpluggable-cpus"
+	QmpQueryCPUsFastCommand         string = "query-cpus-fast"
+)
+
+/* The topology properties device_add needs to plug a vCPU into a slot */
+var qemuCPUTopologyProperties []string = []string{"node-id", "drawer-id", "book-id", "socket-id", "die-id", "cluster-id", "core-id", "thread-id"}
+
+type qmpHotpluggableCPU struct {
+	Type       string           `json:"type"`
+	VCPUsCount int              `json:"vcpus-count"`
+	Props      map[string]int64 `json:"props"`
+	QomPath    string           `json:"qom-path"`
+}
+
+/* deviceID names a vCPU after its slot, e.g. qemuctl-cpu-s0-c3-t0 */
+func (cpu *qmpHotpluggableCPU) deviceID() string {
+	return fmt.Sprintf("%s-s%d-c%d-t%d", QemuCPUDevicePrefix,
+		cpu.Props["socket-id"], cpu.Props["core-id"], cpu.Props["thread-id"])
+}
+
+/* order sorts slots the way the guest numbers its CPUs */
+func (cpu *qmpHotpluggableCPU) order() int64 {
+	return cpu.Props["socket-id"]<<32 | cpu.Props["core-id"]<<16 | cpu.Props["thread-id"]
+}
+
+func (monitor *QemuMonitor) queryHotpluggableCPUs(ctx context.Context, client *QmpClient) (cpus []qmpHotpluggableCPU, err error) {
+	err = client.Execute(ctx, QmpQueryHotpluggableCPUsCommand, nil, &cpus)
+	if err != nil {
+		if IsQmpErrorClass(err, QmpErrorClassGenericError) {
+			return nil, fmt.Errorf("machine '%s' does not support CPU hotplug: %s", monitor.Machine.Name, err.Error())
+		}
+		return nil, err
+	}
+
+	sort.Slice(cpus, func(i, j int) bool {
+		return cpus[i].order() < cpus[j].order()
+	})
+
+	return cpus, nil
+}
+
+/* QueryCPUs returns how many vCPUs the guest has and how many it may have */
+func (monitor *QemuMonitor) QueryCPUs(ctx context.Context) (online int, maximum int, err error) {
+	var client *QmpClient
+	var vcpus []struct {
+		Index int `json:"cpu-index"`
+	}
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer client.Close()
+
+	err = client.Execute(ctx, QmpQueryCPUsFastCommand, nil, &vcpus)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	slots, err := monitor.queryHotpluggableCPUs(ctx, client)
+	if err != nil {
+		/* Not hotpluggable: what is there is all there will be */
+		return len(vcpus), len(vcpus), nil
+	}
+
+	for _, slot := range slots {
+		maximum += slot.VCPUsCount
+	}
+
+	return len(vcpus), maximum, nil
+}
+
+/*
+ * SetCPUs plugs vCPUs into free slots, or unplugs the ones qemuctl added,
+ * until the guest has count vCPUs. CPUs present at boot cannot be removed.
+ */
+func (monitor *QemuMonitor) SetCPUs(ctx context.Context, count int) (err error) {
+	var client *QmpClient
+	var plugged []qmpHotpluggableCPU
+	var free []qmpHotpluggableCPU
+	var online int = 0
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	slots, err := monitor.queryHotpluggableCPUs(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	for _, slot := range slots {
+		if len(slot.QomPath) > 0 {
+			plugged = append(plugged, slot)
+			online += slot.VCPUsCount
+		} else {
+			free = append(free, slot)
+		}
+	}
+
+	if count > online+len(free) {
+		return fmt.Errorf("machine '%s' can have at most %d vCPUs", monitor.Machine.Name, online+len(free))
+	}
+
+	/* Plug the lowest free slots first */
+	for index := 0; online < count; index++ {
+		slot := free[index]
+		arguments := map[string]interface{}{
+			"driver": slot.Type,
+			"id":     slot.deviceID(),
+		}
+
+		for _, property := range qemuCPUTopologyProperties {
+			if value, ok := slot.Props[property]; ok {
+				arguments[property] = value
+			}
+		}
+
+		log.Printf("[SetCPUs] adding vCPU '%s'", slot.deviceID())
+		if err = client.Execute(ctx, QmpDeviceAddCommand, arguments, nil); err != nil {
+			return err
+		}
+		online += slot.VCPUsCount
+	}
+
+	/* Unplug the highest slots first; only our own devices can go */
+	for index := len(plugged) - 1; online > count && index >= 0; index-- {
+		slot := plugged[index]
+		deviceID := slot.QomPath[strings.LastIndex(slot.QomPath, "/")+1:]
+
+		if !strings.HasPrefix(deviceID, QemuCPUDevicePrefix) {
+			return fmt.Errorf("vCPU '%s' was present at boot and cannot be removed", slot.QomPath)
+		}
+
+		if err = monitor.removeDevice(ctx, client, deviceID); err != nil {
+			return err
+		}
+		online -= slot.VCPUsCount
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	QemuDiskBusVirtio        string = "virtio"
+	QemuDiskBusSCSI          string = "scsi"
+	QemuDiskFormatQcow2      string = "qcow2"
+	QemuDiskFormatRaw        string = "raw"
+	QemuDiskNodeSuffix       string = "-drive"
+	QemuDiskSCSIControllerID string = "qemuctl-scsi0"
+
+	QmpBlockdevAddCommand string = "blockdev-add"
+	QmpBlockdevDelCommand string = "blockdev-del"
+	QmpDeviceAddCommand   string = "device_add"
+	QmpDeviceDelCommand   string = "device_del"
+	QmpQomListCommand     string = "qom-list"
+)
+
+// QemuDisk describes a disk attached with a -blockdev/-device pair
+type QemuDisk struct {
+	ID      string
+	File    string
+	Format  string
+	Bus     string
+	Discard bool
+}
+
+/* EscapeOptionValue doubles commas so value stays one -drive/-blockdev option */
+func EscapeOptionValue(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
+
+func (disk *QemuDisk) NodeName() string {
+	return disk.ID + QemuDiskNodeSuffix
+}
+
+func (disk *QemuDisk) IsHostDevice() bool {
+	fileInfo, err := os.Stat(disk.File)
+
+	return err == nil && fileInfo.Mode()&os.ModeDevice != 0
+}
+
+func (disk *QemuDisk) Validate() error {
+	if len(disk.ID) == 0 {
+		return fmt.Errorf("disk id is mandatory")
+	}
+
+	if len(disk.File) == 0 {
+		return fmt.Errorf("disk file is mandatory")
+	}
+
+	switch disk.Format {
+	case QemuDiskFormatQcow2, QemuDiskFormatRaw:
+	default:
+		return fmt.Errorf("unsupported disk format '%s'", disk.Format)
+	}
+
+	switch disk.Bus {
+	case QemuDiskBusVirtio, QemuDiskBusSCSI:
+	default:
+		return fmt.Errorf("unsupported disk bus '%s'", disk.Bus)
+	}
+
+	if disk.Format == QemuDiskFormatQcow2 && disk.IsHostDevice() {
+		return fmt.Errorf("host block devices must use the '%s' format", QemuDiskFormatRaw)
+	}
+
+	return nil
+}
+
+func (disk *QemuDisk) fileDriver() string {
+	if disk.IsHostDevice() {
+		return "host_device"
+	}
+
+	return "file"
+}
+
+func (disk *QemuDisk) discardMode() string {
+	if disk.Discard {
+		return "unmap"
+	}
+
+	return "ignore"
+}
+
+func (disk *QemuDisk) deviceDriver() string {
+	if disk.Bus == QemuDiskBusSCSI {
+		return "scsi-hd"
+	}
+
+	return "virtio-blk-pci"
+}
+
+/* QMP arguments for blockdev-add */
+func (disk *QemuDisk) BlockdevArguments() map[string]interface{} {
+	return map[string]interface{}{
+		"node-name": disk.NodeName(),
+		"driver":    disk.Format,
+		"discard":   disk.discardMode(),
+		"file": map[string]interface{}{
+			"driver":   disk.fileDriver(),
+			"filename": disk.File,
+		},
+	}
+}
+
+/* QMP arguments for device_add */
+func (disk *QemuDisk) DeviceArguments() map[string]interface{} {
+	arguments := map[string]interface{}{
+		"driver": disk.deviceDriver(),
+		"id":     disk.ID,
+		"drive":  disk.NodeName(),
+	}
+
+	if disk.Bus == QemuDiskBusSCSI {
+		arguments["bus"] = QemuDiskSCSIControllerID + ".0"
+	}
+
+	return arguments
+}
+
+/* Command line form of BlockdevArguments, for -blockdev */
+func (disk *QemuDisk) BlockdevSpec() string {
+	return fmt.Sprintf("node-name=%s,driver=%s,discard=%s,file.driver=%s,file.filename=%s",
+		disk.NodeName(), disk.Format, disk.discardMode(), disk.fileDriver(), EscapeOptionValue(disk.File))
+}
+
+/* Command line form of DeviceArguments, for -device */
+func (disk *QemuDisk) DeviceSpec() string {
+	spec := fmt.Sprintf("%s,id=%s,drive=%s", disk.deviceDriver(), disk.ID, disk.NodeName())
+
+	if disk.Bus == QemuDiskBusSCSI {
+		spec = fmt.Sprintf("%s,bus=%s.0", spec, QemuDiskSCSIControllerID)
+	}
+
+	return spec
+}
+
+func (monitor *QemuMonitor) deviceExists(ctx context.Context, client *QmpClient, deviceID string) (exists bool, err error) {
+	arguments := map[string]string{
+		"path": "/machine/peripheral/" + deviceID,
+	}
+
+	err = client.Execute(ctx, QmpQomListCommand, arguments, nil)
+	if err == nil {
+		return true, nil
+	} else if IsQmpErrorClass(err, QmpErrorClassDeviceNotFound) || IsQmpErrorClass(err, QmpErrorClassGenericError) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func (monitor *QemuMonitor) AttachDisk(ctx context.Context, disk *QemuDisk) (err error) {
+	var client *QmpClient
+
+	if err = disk.Validate(); err != nil {
+		return err
+	}
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if disk.Bus == QemuDiskBusSCSI {
+		exists, err := monitor.deviceExists(ctx, client, QemuDiskSCSIControllerID)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			log.Printf("[AttachDisk] adding SCSI controller '%s'", QemuDiskSCSIControllerID)
+			err = client.Execute(ctx, QmpDeviceAddCommand, map[string]string{
+				"driver": "virtio-scsi-pci",
+				"id":     QemuDiskSCSIControllerID,
+			}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("[AttachDisk] adding block node '%s' for '%s'", disk.NodeName(), disk.File)
+	err = client.Execute(ctx, QmpBlockdevAddCommand, disk.BlockdevArguments(), nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[AttachDisk] adding device '%s'", disk.ID)
+	err = client.Execute(ctx, QmpDeviceAddCommand, disk.DeviceArguments(), nil)
+	if err != nil {
+		/* Do not leave an orphan block node behind */
+		if _err := client.Execute(ctx, QmpBlockdevDelCommand, map[string]string{"node-name": disk.NodeName()}, nil); _err != nil {
+			log.Printf("[AttachDisk] could not remove block node '%s': %s", disk.NodeName(), _err.Error())
+		}
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * removeDevice issues device_del and waits for the guest to release the
+ * device, which QEMU reports with DEVICE_DELETED.
+ */
+func (monitor *QemuMonitor) removeDevice(ctx context.Context, client *QmpClient, deviceID string) (err error) {
+	subscription := client.Subscribe("DEVICE_DELETED")
+	defer subscription.Close()
+
+	log.Printf("[removeDevice] removing device '%s'", deviceID)
+	err = client.Execute(ctx, QmpDeviceDelCommand, map[string]string{"id": deviceID}, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return client.Err()
+			}
+			var data struct {
+				Device string `json:"device"`
+			}
+			if json.Unmarshal(event.Data, &data) == nil && data.Device == deviceID {
+				log.Printf("[removeDevice] device '%s' deleted", deviceID)
+				return nil
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("guest did not release device '%s': %w", deviceID, ctx.Err())
+		}
+	}
+}
+
+func (monitor *QemuMonitor) DetachDisk(ctx context.Context, diskID string) (err error) {
+	var client *QmpClient
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = monitor.removeDevice(ctx, client, diskID); err != nil {
+		return err
+	}
+
+	log.Printf("[DetachDisk] removing block node '%s'", diskID+QemuDiskNodeSuffix)
+	return client.Execute(ctx, QmpBlockdevDelCommand, map[string]string{"node-name": diskID + QemuDiskNodeSuffix}, nil)
+}
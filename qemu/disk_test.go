@@ -0,0 +1,116 @@
+package qemuctl_qemu
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiskSpecs(t *testing.T) {
+	tests := []struct {
+		name         string
+		disk         QemuDisk
+		wantBlockdev string
+		wantDevice   string
+	}{
+		{
+			name:         "virtio qcow2",
+			disk:         QemuDisk{ID: "data", File: "/var/lib/vm/data.qcow2", Format: QemuDiskFormatQcow2, Bus: QemuDiskBusVirtio},
+			wantBlockdev: "node-name=data-drive,driver=qcow2,discard=ignore,file.driver=file,file.filename=/var/lib/vm/data.qcow2",
+			wantDevice:   "virtio-blk-pci,id=data,drive=data-drive",
+		},
+		{
+			name:         "scsi raw with discard",
+			disk:         QemuDisk{ID: "scratch", File: "/tmp/scratch.img", Format: QemuDiskFormatRaw, Bus: QemuDiskBusSCSI, Discard: true},
+			wantBlockdev: "node-name=scratch-drive,driver=raw,discard=unmap,file.driver=file,file.filename=/tmp/scratch.img",
+			wantDevice:   "scsi-hd,id=scratch,drive=scratch-drive,bus=qemuctl-scsi0.0",
+		},
+		{
+			name:         "commas in the file name",
+			disk:         QemuDisk{ID: "odd", File: "/tmp/a,b,,c.img", Format: QemuDiskFormatRaw, Bus: QemuDiskBusVirtio},
+			wantBlockdev: "node-name=odd-drive,driver=raw,discard=ignore,file.driver=file,file.filename=/tmp/a,,b,,,,c.img",
+			wantDevice:   "virtio-blk-pci,id=odd,drive=odd-drive",
+		},
+	}
+
+	for _, test := range tests {
+		if got := test.disk.BlockdevSpec(); got != test.wantBlockdev {
+			t.Errorf("%s: BlockdevSpec() = '%s', want '%s'", test.name, got, test.wantBlockdev)
+		}
+		if got := test.disk.DeviceSpec(); got != test.wantDevice {
+			t.Errorf("%s: DeviceSpec() = '%s', want '%s'", test.name, got, test.wantDevice)
+		}
+
+		/* The QMP form takes the file name as is */
+		file := test.disk.BlockdevArguments()["file"].(map[string]interface{})
+		if file["filename"] != test.disk.File {
+			t.Errorf("%s: blockdev-add filename = '%v', want '%s'", test.name, file["filename"], test.disk.File)
+		}
+	}
+}
+
+func TestDiskValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		disk    QemuDisk
+		wantErr string
+	}{
+		{
+			name: "valid",
+			disk: QemuDisk{ID: "data", File: "/tmp/data.qcow2", Format: QemuDiskFormatQcow2, Bus: QemuDiskBusVirtio},
+		},
+		{
+			name:    "missing id",
+			disk:    QemuDisk{File: "/tmp/data.qcow2", Format: QemuDiskFormatQcow2, Bus: QemuDiskBusVirtio},
+			wantErr: "disk id is mandatory",
+		},
+		{
+			name:    "missing file",
+			disk:    QemuDisk{ID: "data", Format: QemuDiskFormatQcow2, Bus: QemuDiskBusVirtio},
+			wantErr: "disk file is mandatory",
+		},
+		{
+			name:    "unknown format",
+			disk:    QemuDisk{ID: "data", File: "/tmp/data.vmdk", Format: "vmdk", Bus: QemuDiskBusVirtio},
+			wantErr: "unsupported disk format 'vmdk'",
+		},
+		{
+			name:    "unknown bus",
+			disk:    QemuDisk{ID: "data", File: "/tmp/data.img", Format: QemuDiskFormatRaw, Bus: "ide"},
+			wantErr: "unsupported disk bus 'ide'",
+		},
+		{
+			name:    "qcow2 on a host device",
+			disk:    QemuDisk{ID: "null", File: "/dev/null", Format: QemuDiskFormatQcow2, Bus: QemuDiskBusVirtio},
+			wantErr: "host block devices must use the 'raw' format",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.disk.Validate()
+		if len(test.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err.Error())
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: got error %v, want '%s'", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestEscapeOptionValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"/var/lib/vm/disk.qcow2", "/var/lib/vm/disk.qcow2"},
+		{"a,b", "a,,b"},
+		{",,", ",,,,"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := EscapeOptionValue(test.value); got != test.want {
+			t.Errorf("EscapeOptionValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
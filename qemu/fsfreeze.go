@@ -0,0 +1,95 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	QgaFsFreezeCommand       string = "guest-fsfreeze-freeze"
+	QgaFsThawCommand         string = "guest-fsfreeze-thaw"
+	QgaFsFreezeStatusCommand string = "guest-fsfreeze-status"
+
+	QgaFsFreezeStatusFrozen string = "frozen"
+	QgaFsFreezeStatusThawed string = "thawed"
+
+	/* Longest time filesystems stay frozen around a disk operation */
+	QgaFsFreezeSafetyTimeout = 60 * time.Second
+)
+
+/* QemuFreezeHook freezes the guest right before a disk operation starts and returns the thaw */
+type QemuFreezeHook func() (thaw func())
+
+func (monitor *QemuMonitor) GuestFsFreeze(ctx context.Context) (count int, err error) {
+	err = monitor.executeAgentCommand(ctx, QgaFsFreezeCommand, nil, &count)
+	return count, err
+}
+
+func (monitor *QemuMonitor) GuestFsThaw(ctx context.Context) (count int, err error) {
+	err = monitor.executeAgentCommand(ctx, QgaFsThawCommand, nil, &count)
+	return count, err
+}
+
+func (monitor *QemuMonitor) GuestFsFreezeStatus(ctx context.Context) (status string, err error) {
+	err = monitor.executeAgentCommand(ctx, QgaFsFreezeStatusCommand, nil, &status)
+	return status, err
+}
+
+/*
+ * FreezeFilesystems freezes the guest filesystems and returns a function to
+ * thaw them. The thaw also fires on its own after safetyTimeout so a stuck
+ * operation never leaves the guest frozen, as long as qemuctl itself lives:
+ * the agent has no timeout of its own. Machines without an agent channel
+ * are left alone.
+ */
+func (monitor *QemuMonitor) FreezeFilesystems(ctx context.Context, safetyTimeout time.Duration) (thaw func(), err error) {
+	var once sync.Once
+
+	if _, err = os.Stat(monitor.GetGuestAgentSocketPath()); err != nil {
+		log.Printf("[FreezeFilesystems] machine '%s' has no guest agent channel, not freezing", monitor.Machine.Name)
+		return func() {}, nil
+	}
+
+	count, err := monitor.GuestFsFreeze(ctx)
+	if err != nil {
+		/* A failed freeze may still have frozen some filesystems */
+		monitor.GuestFsThaw(ctx)
+		return func() {}, err
+	}
+	log.Printf("[FreezeFilesystems] froze %d filesystem(s) of machine '%s'", count, monitor.Machine.Name)
+
+	/* thaw and the safety timeout only meet through once and thawed */
+	var thawed chan struct{} = make(chan struct{})
+	thaw = func() {
+		once.Do(func() {
+			close(thawed)
+
+			thawCtx, cancel := context.WithTimeout(context.Background(), QgaDefaultTimeout)
+			defer cancel()
+
+			count, err := monitor.GuestFsThaw(thawCtx)
+			if err != nil {
+				log.Printf("[FreezeFilesystems] could not thaw machine '%s': %s", monitor.Machine.Name, err.Error())
+				return
+			}
+			log.Printf("[FreezeFilesystems] thawed %d filesystem(s) of machine '%s'", count, monitor.Machine.Name)
+		})
+	}
+
+	go func() {
+		timer := time.NewTimer(safetyTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			log.Printf("[FreezeFilesystems] safety timeout (%s) reached, thawing machine '%s'", safetyTimeout, monitor.Machine.Name)
+			thaw()
+		case <-thawed:
+		}
+	}()
+
+	return thaw, nil
+}
@@ -0,0 +1,172 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	QgaExecShell     string = "/bin/sh"
+	QgaExecOutputDir string = "/tmp"
+
+	/*
+	 * Sends the command's stdout and stderr to "$0.out" and "$0.err"; with
+	 * noclobber set, nothing planted at those names is followed.
+	 */
+	QgaExecStreamScript string = `set -C; exec "$@" >"$0.out" 2>"$0.err"`
+)
+
+/* qgaFileReadAvailable reads whatever has been written to handle since the last call */
+func qgaFileReadAvailable(ctx context.Context, client *QgaClient, handle int64) (data []byte, err error) {
+	/* Seeking in place clears the stream's EOF, so the file can keep growing */
+	if _, err = qgaFileSeek(ctx, client, handle, 0, "cur"); err != nil {
+		return nil, err
+	}
+
+	for {
+		var result qgaFileReadResult
+
+		arguments := map[string]int64{"handle": handle, "count": int64(QgaFileChunkSize)}
+		if err = client.Execute(ctx, QgaFileReadCommand, arguments, &result); err != nil {
+			return nil, err
+		}
+
+		chunk, err := base64.StdEncoding.DecodeString(result.Buffer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data from guest agent: %s", err.Error())
+		}
+		data = append(data, chunk...)
+
+		if result.EOF || result.Count < QgaFileChunkSize {
+			return data, nil
+		}
+	}
+}
+
+/*
+ * GuestExecStream runs path like GuestExec, but passes its output along while
+ * it runs. The agent only hands out captured output once a process exits, so
+ * a /bin/sh wrapper sends stdout and stderr to files in the guest, which are
+ * read as they grow. Guests without /bin/sh (e.g. Windows) need GuestExec.
+ */
+func (monitor *QemuMonitor) GuestExecStream(ctx context.Context, path string, args []string, env []string, input []byte, output QgaExecOutput) (status *QgaExecStatus, err error) {
+	var interval time.Duration = QgaExecPollInterval
+	var handles []int64
+	var suffix []byte = make([]byte, 8)
+
+	if _, err = rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	base := fmt.Sprintf("%s/qemuctl-exec-%x", QgaExecOutputDir, suffix)
+	files := []string{base + ".out", base + ".err"}
+
+	client, err := monitor.GetGuestAgent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	pid, err := startGuestExec(ctx, client, QgaExecShell, append([]string{"-c", QgaExecStreamScript, base, path}, args...), env, input)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[GuestExecStream] '%s' started in machine '%s' with pid %d", path, monitor.Machine.Name, pid)
+
+	/* The agent serves one client at a time: let go of it before cleaning up */
+	defer func() {
+		for _, handle := range handles {
+			qgaFileClose(context.Background(), client, handle)
+		}
+		client.Close()
+
+		if err != nil && ctx.Err() != nil {
+			monitor.killGuestProcess(pid)
+		}
+		monitor.removeGuestFiles(files)
+	}()
+
+	for {
+		status = &QgaExecStatus{}
+		if err = client.Execute(ctx, QgaExecStatusCommand, map[string]int{"pid": pid}, status); err != nil {
+			return nil, err
+		}
+
+		/* The shell's own complaints, e.g. when it cannot create the files */
+		if err = passExecOutput(status, output); err != nil {
+			return nil, err
+		}
+
+		/* The shell creates both files right away; retry until it has */
+		if len(handles) == 0 {
+			for _, file := range files {
+				handle, openErr := qgaFileOpen(ctx, client, file, "r")
+				if openErr != nil {
+					break
+				}
+				handles = append(handles, handle)
+			}
+
+			if len(handles) < len(files) {
+				for _, handle := range handles {
+					qgaFileClose(ctx, client, handle)
+				}
+				handles = nil
+			}
+		}
+
+		/* Read after the status: once it says exited, this is all there is */
+		var received bool
+		if len(handles) == len(files) {
+			var stdout, stderr []byte
+
+			if stdout, err = qgaFileReadAvailable(ctx, client, handles[0]); err != nil {
+				return nil, err
+			}
+			if stderr, err = qgaFileReadAvailable(ctx, client, handles[1]); err != nil {
+				return nil, err
+			}
+
+			if received = len(stdout) > 0 || len(stderr) > 0; received && output != nil {
+				output(stdout, stderr)
+			}
+		}
+
+		if status.Exited {
+			log.Printf("[GuestExecStream] pid %d exited (code %d, signal %d)", pid, status.ExitCode, status.Signal)
+			return status, nil
+		}
+
+		/* back off while the command is quiet */
+		if received {
+			interval = QgaExecPollInterval
+		} else if interval < QgaExecMaxPollInterval {
+			interval *= 2
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			err = ctx.Err()
+			return nil, err
+		}
+	}
+}
+
+/* removeGuestFiles removes files GuestExecStream left in the guest */
+func (monitor *QemuMonitor) removeGuestFiles(files []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), QgaDefaultTimeout)
+	defer cancel()
+
+	status, err := monitor.GuestExec(ctx, "rm", append([]string{"-f"}, files...), nil, nil, nil)
+	if err == nil && status.ExitCode != 0 {
+		err = fmt.Errorf("rm exited with status %d", status.ExitCode)
+	}
+
+	if err != nil {
+		log.Printf("[removeGuestFiles] could not remove %v: %s", files, err.Error())
+	}
+}
@@ -0,0 +1,225 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	QgaFileOpenCommand  string = "guest-file-open"
+	QgaFileReadCommand  string = "guest-file-read"
+	QgaFileWriteCommand string = "guest-file-write"
+	QgaFileSeekCommand  string = "guest-file-seek"
+	QgaFileCloseCommand string = "guest-file-close"
+
+	/* Each chunk travels base64 encoded in a single agent reply */
+	QgaFileChunkSize int = 1024 * 1024
+)
+
+type qgaFileReadResult struct {
+	Count  int    `json:"count"`
+	Buffer string `json:"buf-b64"`
+	EOF    bool   `json:"eof"`
+}
+
+type qgaFileSeekResult struct {
+	Position int64 `json:"position"`
+	EOF      bool  `json:"eof"`
+}
+
+func qgaFileOpen(ctx context.Context, client *QgaClient, path string, mode string) (handle int64, err error) {
+	err = client.Execute(ctx, QgaFileOpenCommand, map[string]string{"path": path, "mode": mode}, &handle)
+	return handle, err
+}
+
+func qgaFileClose(ctx context.Context, client *QgaClient, handle int64) error {
+	return client.Execute(ctx, QgaFileCloseCommand, map[string]int64{"handle": handle}, nil)
+}
+
+func qgaFileSeek(ctx context.Context, client *QgaClient, handle int64, offset int64, whence string) (position int64, err error) {
+	var result qgaFileSeekResult
+
+	arguments := map[string]interface{}{"handle": handle, "offset": offset, "whence": whence}
+	if err = client.Execute(ctx, QgaFileSeekCommand, arguments, &result); err != nil {
+		return 0, err
+	}
+
+	return result.Position, nil
+}
+
+/* CopyToGuest writes the host file to guestPath in chunks, truncating it */
+func (monitor *QemuMonitor) CopyToGuest(ctx context.Context, hostPath string, guestPath string, progress QemuJobProgress) (err error) {
+	var current int64 = 0
+	var buffer []byte = make([]byte, QgaFileChunkSize)
+
+	file, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	client, err := monitor.GetGuestAgent(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	handle, err := qgaFileOpen(ctx, client, guestPath, "w")
+	if err != nil {
+		return fmt.Errorf("could not open '%s' in the guest: %s", guestPath, err.Error())
+	}
+	defer func() {
+		if closeErr := qgaFileClose(ctx, client, handle); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	log.Printf("[CopyToGuest] copying '%s' (%d bytes) to '%s'", hostPath, fileInfo.Size(), guestPath)
+
+	for {
+		count, readErr := file.Read(buffer)
+		if count > 0 {
+			arguments := map[string]interface{}{
+				"handle":  handle,
+				"buf-b64": base64.StdEncoding.EncodeToString(buffer[:count]),
+			}
+			if err = client.Execute(ctx, QgaFileWriteCommand, arguments, nil); err != nil {
+				return err
+			}
+
+			current += int64(count)
+			if progress != nil {
+				progress(current, fileInfo.Size())
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+/* CopyFromGuest reads guestPath in chunks into the host file */
+func (monitor *QemuMonitor) CopyFromGuest(ctx context.Context, guestPath string, hostPath string, mode os.FileMode, progress QemuJobProgress) (err error) {
+	var current int64 = 0
+
+	client, err := monitor.GetGuestAgent(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	handle, err := qgaFileOpen(ctx, client, guestPath, "r")
+	if err != nil {
+		return fmt.Errorf("could not open '%s' in the guest: %s", guestPath, err.Error())
+	}
+	defer qgaFileClose(ctx, client, handle)
+
+	/* The agent has no stat; seeking to the end gives us the size */
+	total, err := qgaFileSeek(ctx, client, handle, 0, "end")
+	if err != nil {
+		return err
+	}
+	if _, err = qgaFileSeek(ctx, client, handle, 0, "set"); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(hostPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	log.Printf("[CopyFromGuest] copying '%s' (%d bytes) to '%s'", guestPath, total, hostPath)
+
+	for {
+		var result qgaFileReadResult
+		var data []byte
+
+		arguments := map[string]int64{"handle": handle, "count": int64(QgaFileChunkSize)}
+		if err = client.Execute(ctx, QgaFileReadCommand, arguments, &result); err != nil {
+			return err
+		}
+
+		if data, err = base64.StdEncoding.DecodeString(result.Buffer); err != nil {
+			return fmt.Errorf("invalid data from guest agent: %s", err.Error())
+		}
+
+		if _, err = file.Write(data); err != nil {
+			return err
+		}
+
+		current += int64(len(data))
+		if progress != nil {
+			progress(current, total)
+		}
+
+		if result.EOF || result.Count == 0 {
+			break
+		}
+	}
+
+	/* OpenFile's mode is subject to umask */
+	return file.Chmod(mode)
+}
+
+/*
+ * The agent cannot stat or chmod files, so permissions go through guest-exec
+ * and only work on guests with coreutils.
+ */
+func (monitor *QemuMonitor) GuestFileMode(ctx context.Context, guestPath string) (mode os.FileMode, err error) {
+	var output strings.Builder
+
+	status, err := monitor.GuestExec(ctx, "stat", []string{"-c", "%a", guestPath}, nil, nil, func(stdout []byte, stderr []byte) {
+		output.Write(stdout)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if status.ExitCode != 0 {
+		return 0, fmt.Errorf("stat exited with status %d", status.ExitCode)
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(output.String()), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode '%s'", strings.TrimSpace(output.String()))
+	}
+
+	return os.FileMode(value).Perm(), nil
+}
+
+func (monitor *QemuMonitor) GuestChmod(ctx context.Context, guestPath string, mode os.FileMode) (err error) {
+	status, err := monitor.GuestExec(ctx, "chmod", []string{fmt.Sprintf("%o", mode.Perm()), guestPath}, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if status.ExitCode != 0 {
+		return fmt.Errorf("chmod exited with status %d", status.ExitCode)
+	}
+
+	return nil
+}
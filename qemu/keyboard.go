@@ -0,0 +1,165 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	QmpSendKeyCommand        string = "send-key"
+	QmpInputSendEventCommand string = "input-send-event"
+
+	QemuKeyShift string = "shift"
+)
+
+/* Friendlier names for QEMU qcodes */
+var qemuKeyAliases map[string]string = map[string]string{
+	"control":   "ctrl",
+	"del":       "delete",
+	"enter":     "ret",
+	"return":    "ret",
+	"escape":    "esc",
+	"space":     "spc",
+	"pageup":    "pgup",
+	"pagedown":  "pgdn",
+	"ins":       "insert",
+	"win":       "meta_l",
+	"super":     "meta_l",
+	"meta":      "meta_l",
+	"bksp":      "backspace",
+	"altgr":     "alt_r",
+	"printscrn": "print",
+}
+
+type qemuTypedKey struct {
+	qcode string
+	shift bool
+}
+
+/* US keyboard layout: character -> key (and whether shift is held) */
+var qemuUSLayout map[rune]qemuTypedKey = map[rune]qemuTypedKey{
+	' ': {"spc", false}, '\n': {"ret", false}, '\t': {"tab", false},
+	'`': {"grave_accent", false}, '~': {"grave_accent", true},
+	'1': {"1", false}, '!': {"1", true},
+	'2': {"2", false}, '@': {"2", true},
+	'3': {"3", false}, '#': {"3", true},
+	'4': {"4", false}, '$': {"4", true},
+	'5': {"5", false}, '%': {"5", true},
+	'6': {"6", false}, '^': {"6", true},
+	'7': {"7", false}, '&': {"7", true},
+	'8': {"8", false}, '*': {"8", true},
+	'9': {"9", false}, '(': {"9", true},
+	'0': {"0", false}, ')': {"0", true},
+	'-': {"minus", false}, '_': {"minus", true},
+	'=': {"equal", false}, '+': {"equal", true},
+	'[': {"bracket_left", false}, '{': {"bracket_left", true},
+	']': {"bracket_right", false}, '}': {"bracket_right", true},
+	'\\': {"backslash", false}, '|': {"backslash", true},
+	';': {"semicolon", false}, ':': {"semicolon", true},
+	'\'': {"apostrophe", false}, '"': {"apostrophe", true},
+	',': {"comma", false}, '<': {"comma", true},
+	'.': {"dot", false}, '>': {"dot", true},
+	'/': {"slash", false}, '?': {"slash", true},
+}
+
+func init() {
+	for char := 'a'; char <= 'z'; char++ {
+		qemuUSLayout[char] = qemuTypedKey{string(char), false}
+		qemuUSLayout[char-'a'+'A'] = qemuTypedKey{string(char), true}
+	}
+}
+
+/* ParseKeyCombo turns "ctrl-alt-delete" into the qcodes send-key expects */
+func ParseKeyCombo(combo string) (qcodes []string, err error) {
+	for _, key := range strings.Split(strings.ToLower(combo), "-") {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("invalid key combination '%s'", combo)
+		}
+
+		if alias, ok := qemuKeyAliases[key]; ok {
+			key = alias
+		}
+		qcodes = append(qcodes, key)
+	}
+
+	return qcodes, nil
+}
+
+/* SendKeys presses the keys together, holding them for holdTime */
+func (monitor *QemuMonitor) SendKeys(ctx context.Context, qcodes []string, holdTime time.Duration) (err error) {
+	var keys []map[string]string
+
+	for _, qcode := range qcodes {
+		keys = append(keys, map[string]string{"type": "qcode", "data": qcode})
+	}
+
+	arguments := map[string]interface{}{"keys": keys}
+	if holdTime > 0 {
+		arguments["hold-time"] = holdTime.Milliseconds()
+	}
+
+	log.Printf("[SendKeys] sending %v to machine '%s'", qcodes, monitor.Machine.Name)
+	return monitor.ExecuteCommand(ctx, QmpSendKeyCommand, arguments, nil)
+}
+
+func keyEvent(qcode string, down bool) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "key",
+		"data": map[string]interface{}{
+			"down": down,
+			"key":  map[string]string{"type": "qcode", "data": qcode},
+		},
+	}
+}
+
+/*
+ * TypeText types text as if on a US keyboard, one key press per character
+ * with delay in between so the guest does not drop keys.
+ */
+func (monitor *QemuMonitor) TypeText(ctx context.Context, text string, delay time.Duration) (err error) {
+	var client *QmpClient
+
+	/* Check the whole text before typing any of it */
+	for _, char := range text {
+		if _, ok := qemuUSLayout[char]; !ok {
+			return fmt.Errorf("cannot type %q on a US keyboard", char)
+		}
+	}
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	log.Printf("[TypeText] typing %d characters on machine '%s'", len(text), monitor.Machine.Name)
+
+	for _, char := range text {
+		var events []interface{}
+		key := qemuUSLayout[char]
+
+		if key.shift {
+			events = append(events, keyEvent(QemuKeyShift, true))
+		}
+		events = append(events, keyEvent(key.qcode, true), keyEvent(key.qcode, false))
+		if key.shift {
+			events = append(events, keyEvent(QemuKeyShift, false))
+		}
+
+		err = client.Execute(ctx, QmpInputSendEventCommand, map[string]interface{}{"events": events}, nil)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyCombo(t *testing.T) {
+	tests := []struct {
+		combo   string
+		want    []string
+		wantErr bool
+	}{
+		{combo: "ctrl-alt-delete", want: []string{"ctrl", "alt", "delete"}},
+		{combo: "Ctrl-Alt-Del", want: []string{"ctrl", "alt", "delete"}},
+		{combo: "control-escape", want: []string{"ctrl", "esc"}},
+		{combo: "enter", want: []string{"ret"}},
+		{combo: "RETURN", want: []string{"ret"}},
+		{combo: "super-space", want: []string{"meta_l", "spc"}},
+		{combo: "win-l", want: []string{"meta_l", "l"}},
+		{combo: "shift-pageup", want: []string{"shift", "pgup"}},
+		{combo: "altgr-printscrn", want: []string{"alt_r", "print"}},
+		{combo: "f12", want: []string{"f12"}},
+		{combo: "", wantErr: true},
+		{combo: "ctrl-", wantErr: true},
+		{combo: "-alt", wantErr: true},
+		{combo: "ctrl--c", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseKeyCombo(test.combo)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseKeyCombo(%q) = %v, want an error", test.combo, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseKeyCombo(%q): %s", test.combo, err.Error())
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseKeyCombo(%q) = %v, want %v", test.combo, got, test.want)
+		}
+	}
+}
+
+func TestUSLayout(t *testing.T) {
+	tests := []struct {
+		char  rune
+		qcode string
+		shift bool
+	}{
+		{'a', "a", false},
+		{'z', "z", false},
+		{'A', "a", true},
+		{'Q', "q", true},
+		{'0', "0", false},
+		{')', "0", true},
+		{'!', "1", true},
+		{' ', "spc", false},
+		{'\n', "ret", false},
+		{'\t', "tab", false},
+		{'-', "minus", false},
+		{'_', "minus", true},
+		{'"', "apostrophe", true},
+		{'\\', "backslash", false},
+		{'|', "backslash", true},
+		{'~', "grave_accent", true},
+		{'?', "slash", true},
+	}
+
+	for _, test := range tests {
+		key, ok := qemuUSLayout[test.char]
+		if !ok {
+			t.Errorf("%q is missing from the layout", test.char)
+		} else if key.qcode != test.qcode || key.shift != test.shift {
+			t.Errorf("%q = {%s %v}, want {%s %v}", test.char, key.qcode, key.shift, test.qcode, test.shift)
+		}
+	}
+
+	/* Every printable ASCII character can be typed */
+	for char := rune(' '); char <= '~'; char++ {
+		if _, ok := qemuUSLayout[char]; !ok {
+			t.Errorf("%q is missing from the layout", char)
+		}
+	}
+}
+
+func TestTypeTextRejectsUnknownCharacters(t *testing.T) {
+	monitor := &QemuMonitor{}
+
+	for _, text := range []string{"é", "hello wörld", "no-break\u00a0space", "\r"} {
+		err := monitor.TypeText(context.Background(), text, 0)
+		if err == nil || !strings.Contains(err.Error(), "US keyboard") {
+			t.Errorf("TypeText(%q): got %v, want a layout error", text, err)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	config "github.com/lapuglisi/qemuctl/helpers"
+)
+
+const (
+	QemuMemoryModelDimm       string = "pc-dimm"
+	QemuMemoryModelVirtioMem  string = "virtio-mem"
+	QemuMemoryDevicePrefix    string = "qemuctl-mem"
+	QemuMemoryBackendSuffix   string = "-backend"
+	QemuMemoryBackendRAM      string = "memory-backend-ram"
+	QemuVirtioMemDriver       string = "virtio-mem-pci"
+	QemuVirtioMemRequestedKey string = "requested-size"
+	QemuPeripheralPath        string = "/machine/peripheral/"
+
+	QmpObjectAddCommand              string = "object-add"
+	QmpObjectDelCommand              string = "object-del"
+	QmpQomSetCommand                 string = "qom-set"
+	QmpQueryMemoryDevicesCommand     string = "query-memory-devices"
+	QmpQueryMemorySizeSummaryCommand string = "query-memory-size-summary"
+)
+
+// QemuMemoryDevice is a hot-pluggable memory device of the running machine
+type QemuMemoryDevice struct {
+	ID            string
+	Model         string
+	Size          int64
+	RequestedSize int64
+	MaxSize       int64
+	Backend       string
+}
+
+type qmpMemoryDeviceInfo struct {
+	Type string `json:"type"`
+	Data struct {
+		ID            string `json:"id"`
+		Size          int64  `json:"size"`
+		RequestedSize int64  `json:"requested-size"`
+		MaxSize       int64  `json:"max-size"`
+		Memdev        string `json:"memdev"`
+	} `json:"data"`
+}
+
+/* QueryMemory returns the boot memory, the plugged memory and the memory devices */
+func (monitor *QemuMonitor) QueryMemory(ctx context.Context) (base int64, plugged int64, devices []QemuMemoryDevice, err error) {
+	var client *QmpClient
+	var summary struct {
+		BaseMemory    int64 `json:"base-memory"`
+		PluggedMemory int64 `json:"plugged-memory"`
+	}
+	var infos []qmpMemoryDeviceInfo
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer client.Close()
+
+	if err = client.Execute(ctx, QmpQueryMemorySizeSummaryCommand, nil, &summary); err != nil {
+		return 0, 0, nil, err
+	}
+
+	if err = client.Execute(ctx, QmpQueryMemoryDevicesCommand, nil, &infos); err != nil {
+		return 0, 0, nil, err
+	}
+
+	for _, info := range infos {
+		device := QemuMemoryDevice{
+			ID:            info.Data.ID,
+			Model:         info.Type,
+			Size:          info.Data.Size,
+			RequestedSize: info.Data.RequestedSize,
+			MaxSize:       info.Data.MaxSize,
+			Backend:       info.Data.Memdev,
+		}
+
+		/* query-memory-devices says 'dimm' for pc-dimm */
+		if device.Model == "dimm" {
+			device.Model = QemuMemoryModelDimm
+		}
+		devices = append(devices, device)
+	}
+
+	return summary.BaseMemory, summary.PluggedMemory, devices, nil
+}
+
+/* nextMemoryDeviceID returns the first qemuctl-memN id not in use */
+func (monitor *QemuMonitor) nextMemoryDeviceID(ctx context.Context, client *QmpClient) (deviceID string, err error) {
+	var infos []qmpMemoryDeviceInfo
+
+	if err = client.Execute(ctx, QmpQueryMemoryDevicesCommand, nil, &infos); err != nil {
+		return "", err
+	}
+
+	for index := 0; ; index++ {
+		deviceID = fmt.Sprintf("%s%d", QemuMemoryDevicePrefix, index)
+		inUse := false
+
+		for _, info := range infos {
+			if info.Data.ID == deviceID {
+				inUse = true
+				break
+			}
+		}
+
+		if !inUse {
+			return deviceID, nil
+		}
+	}
+}
+
+/*
+ * freeDeviceMemory returns how much of the machine's maxMemory is still free
+ * for memory devices. A virtio-mem device takes its whole backend, not just
+ * what the guest was given.
+ */
+func (monitor *QemuMonitor) freeDeviceMemory(ctx context.Context, client *QmpClient) (free int64, err error) {
+	var summary struct {
+		BaseMemory int64 `json:"base-memory"`
+	}
+	var infos []qmpMemoryDeviceInfo
+
+	configData, err := config.NewConfigHandler(monitor.Machine.ConfigFile).ParseConfigFile()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(configData.MaxMemory) == 0 {
+		return 0, fmt.Errorf("machine '%s' has no maxMemory", monitor.Machine.Name)
+	}
+
+	free, err = ParseMemorySize(configData.MaxMemory)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = client.Execute(ctx, QmpQueryMemorySizeSummaryCommand, nil, &summary); err != nil {
+		return 0, err
+	}
+
+	if err = client.Execute(ctx, QmpQueryMemoryDevicesCommand, nil, &infos); err != nil {
+		return 0, err
+	}
+
+	free -= summary.BaseMemory
+	for _, info := range infos {
+		if info.Data.MaxSize > 0 {
+			free -= info.Data.MaxSize
+		} else {
+			free -= info.Data.Size
+		}
+	}
+
+	if free <= 0 {
+		return 0, fmt.Errorf("machine '%s' has no memory left below maxMemory", monitor.Machine.Name)
+	}
+
+	return free, nil
+}
+
+/*
+ * AddMemory plugs size bytes of RAM into the guest: a memory-backend-ram
+ * object plus a pc-dimm or virtio-mem device using it. A virtio-mem backend
+ * is maxSize bytes (all the free room below maxMemory when 0) so the device
+ * can be resized up to that later; only size bytes are requested at first.
+ */
+func (monitor *QemuMonitor) AddMemory(ctx context.Context, model string, size int64, maxSize int64) (deviceID string, err error) {
+	var client *QmpClient
+	var deviceArguments map[string]interface{}
+	var backendSize int64 = size
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	deviceID, err = monitor.nextMemoryDeviceID(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	backendID := deviceID + QemuMemoryBackendSuffix
+
+	switch model {
+	case QemuMemoryModelDimm:
+		deviceArguments = map[string]interface{}{
+			"driver": QemuMemoryModelDimm,
+			"id":     deviceID,
+			"memdev": backendID,
+		}
+	case QemuMemoryModelVirtioMem:
+		{
+			if maxSize == 0 {
+				if maxSize, err = monitor.freeDeviceMemory(ctx, client); err != nil {
+					return "", err
+				}
+			}
+
+			if size > maxSize {
+				return "", fmt.Errorf("requested size %s is above the maximum of %s",
+					FormatMemorySize(size), FormatMemorySize(maxSize))
+			}
+			backendSize = maxSize
+
+			deviceArguments = map[string]interface{}{
+				"driver":                  QemuVirtioMemDriver,
+				"id":                      deviceID,
+				"memdev":                  backendID,
+				QemuVirtioMemRequestedKey: size,
+			}
+		}
+	default:
+		return "", fmt.Errorf("unsupported memory model '%s'", model)
+	}
+
+	log.Printf("[AddMemory] adding backend '%s' (%d bytes)", backendID, backendSize)
+	err = client.Execute(ctx, QmpObjectAddCommand, map[string]interface{}{
+		"qom-type": QemuMemoryBackendRAM,
+		"id":       backendID,
+		"size":     backendSize,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("[AddMemory] adding %s device '%s'", model, deviceID)
+	err = client.Execute(ctx, QmpDeviceAddCommand, deviceArguments, nil)
+	if err != nil {
+		/* Do not leave an orphan backend behind */
+		if _err := client.Execute(ctx, QmpObjectDelCommand, map[string]string{"id": backendID}, nil); _err != nil {
+			log.Printf("[AddMemory] could not remove backend '%s': %s", backendID, _err.Error())
+		}
+		return "", err
+	}
+
+	return deviceID, nil
+}
+
+/*
+ * ResizeMemory changes how much of a virtio-mem device the guest gets; it
+ * cannot go past the size of the device's backend.
+ */
+func (monitor *QemuMonitor) ResizeMemory(ctx context.Context, deviceID string, size int64) (err error) {
+	var client *QmpClient
+	var infos []qmpMemoryDeviceInfo
+	var device *qmpMemoryDeviceInfo
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = client.Execute(ctx, QmpQueryMemoryDevicesCommand, nil, &infos); err != nil {
+		return err
+	}
+
+	for index := range infos {
+		if infos[index].Data.ID == deviceID {
+			device = &infos[index]
+		}
+	}
+
+	if device == nil {
+		return fmt.Errorf("memory device '%s' not found", deviceID)
+	}
+
+	if device.Type != QemuMemoryModelVirtioMem {
+		return fmt.Errorf("'%s' is a %s device; only virtio-mem devices can be resized", deviceID, device.Type)
+	}
+
+	if size > device.Data.MaxSize {
+		return fmt.Errorf("'%s' cannot grow past its maximum of %s", deviceID, FormatMemorySize(device.Data.MaxSize))
+	}
+
+	log.Printf("[ResizeMemory] setting '%s' of '%s' to %d bytes", QemuVirtioMemRequestedKey, deviceID, size)
+
+	return client.Execute(ctx, QmpQomSetCommand, map[string]interface{}{
+		"path":     QemuPeripheralPath + deviceID,
+		"property": QemuVirtioMemRequestedKey,
+		"value":    size,
+	}, nil)
+}
+
+/* RemoveMemory unplugs a pc-dimm device and drops its backend */
+func (monitor *QemuMonitor) RemoveMemory(ctx context.Context, deviceID string) (err error) {
+	var client *QmpClient
+	var infos []qmpMemoryDeviceInfo
+	var backendID string
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = client.Execute(ctx, QmpQueryMemoryDevicesCommand, nil, &infos); err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if info.Data.ID == deviceID {
+			if info.Type != "dimm" {
+				return fmt.Errorf("'%s' is a %s device; resize it to 0 instead", deviceID, info.Type)
+			}
+			/* memdev is a QOM path, e.g. /objects/qemuctl-mem0-backend */
+			backendID = info.Data.Memdev[strings.LastIndex(info.Data.Memdev, "/")+1:]
+		}
+	}
+
+	if len(backendID) == 0 {
+		return fmt.Errorf("memory device '%s' not found", deviceID)
+	}
+
+	if err = monitor.removeDevice(ctx, client, deviceID); err != nil {
+		return err
+	}
+
+	log.Printf("[RemoveMemory] removing backend '%s'", backendID)
+	return client.Execute(ctx, QmpObjectDelCommand, map[string]string{"id": backendID}, nil)
+}
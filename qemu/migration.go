@@ -0,0 +1,353 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	QemuSavedStateFileName      string = "saved-state.bin"
+	QemuSavedStateFdName        string = "qemuctl-saved-state"
+	QemuMigrationSocketName     string = "migration.sock"
+	QemuMigrationFdName         string = "qemuctl-migration"
+	QemuPostcopyRAMCapability   string = "postcopy-ram"
+	QemuHostForwardSSHGuestPort int    = 22
+
+	QmpMigrateCommand                string = "migrate"
+	QmpQueryMigrateCommand           string = "query-migrate"
+	QmpMigrateSetCapabilitiesCommand string = "migrate-set-capabilities"
+	QmpMigrateStartPostcopyCommand   string = "migrate-start-postcopy"
+	QmpMigrateCancelCommand          string = "migrate_cancel"
+
+	QmpMigrationStatusActive    string = "active"
+	QmpMigrationStatusCompleted string = "completed"
+	QmpMigrationStatusFailed    string = "failed"
+	QmpMigrationStatusCancelled string = "cancelled"
+	QmpRunStateInMigrate        string = "inmigrate"
+	QmpMigrationPollInterval           = 500 * time.Millisecond
+)
+
+// QemuMigrationInfo is the part of query-migrate we care about
+type QemuMigrationInfo struct {
+	Status string `json:"status"`
+	RAM    *struct {
+		Transferred int64 `json:"transferred"`
+		Remaining   int64 `json:"remaining"`
+		Total       int64 `json:"total"`
+		DirtySyncs  int64 `json:"dirty-sync-count"`
+	} `json:"ram"`
+	ErrorDesc string `json:"error-desc"`
+}
+
+/* shellQuote quotes value for the /bin/sh that runs exec: migration URIs */
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func (monitor *QemuMonitor) GetSavedStatePath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuSavedStateFileName)
+}
+
+/*
+ * GetSavedStateIncomingURI is what '-incoming' needs to load the saved state
+ * back. QEMU starts the incoming side before dropping privileges, so cat can
+ * still read the runtime directory.
+ */
+func (monitor *QemuMonitor) GetSavedStateIncomingURI() string {
+	return "exec:cat " + shellQuote(monitor.GetSavedStatePath())
+}
+
+func (monitor *QemuMonitor) GetMigrationSocketPath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuMigrationSocketName)
+}
+
+/*
+ * WaitMigration polls query-migrate until the migration completes or fails.
+ * Progress is reported in RAM bytes. With postcopy set, the guest switches
+ * to the destination once the first pass over its RAM is done.
+ */
+func (monitor *QemuMonitor) WaitMigration(ctx context.Context, client *QmpClient, postcopy bool, progress QemuJobProgress) (err error) {
+	var ticker *time.Ticker = time.NewTicker(QmpMigrationPollInterval)
+	var postcopyStarted bool = false
+	defer ticker.Stop()
+
+	for {
+		var info QemuMigrationInfo
+
+		err = client.Execute(ctx, QmpQueryMigrateCommand, nil, &info)
+		if err != nil {
+			return err
+		}
+
+		if progress != nil && info.RAM != nil {
+			progress(info.RAM.Transferred, info.RAM.Transferred+info.RAM.Remaining)
+		}
+
+		if postcopy && !postcopyStarted && info.Status == QmpMigrationStatusActive &&
+			info.RAM != nil && info.RAM.DirtySyncs > 1 {
+			log.Printf("[WaitMigration] switching migration of '%s' to postcopy", monitor.Machine.Name)
+			if err = client.Execute(ctx, QmpMigrateStartPostcopyCommand, nil, nil); err != nil {
+				return err
+			}
+			postcopyStarted = true
+		}
+
+		switch info.Status {
+		case QmpMigrationStatusCompleted:
+			{
+				log.Printf("[WaitMigration] migration of '%s' completed", monitor.Machine.Name)
+				return nil
+			}
+		case QmpMigrationStatusFailed, QmpMigrationStatusCancelled:
+			return fmt.Errorf("migration %s: %s", info.Status, info.ErrorDesc)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("migration did not finish: %w", ctx.Err())
+		}
+	}
+}
+
+/*
+ * cancelMigration stops a migration we gave up on and waits until QEMU
+ * agrees it is over. A migration in postcopy cannot be cancelled.
+ */
+func (monitor *QemuMonitor) cancelMigration(client *QmpClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), QmpDefaultTimeout)
+	defer cancel()
+
+	log.Printf("[cancelMigration] cancelling migration of '%s'", monitor.Machine.Name)
+	if err := client.Execute(ctx, QmpMigrateCancelCommand, nil, nil); err != nil {
+		log.Printf("[cancelMigration] could not cancel migration of '%s': %s", monitor.Machine.Name, err.Error())
+		return
+	}
+
+	if err := monitor.WaitMigration(ctx, client, false, nil); err != nil {
+		log.Printf("[cancelMigration] %s", err.Error())
+	}
+}
+
+/*
+ * SaveState pauses the guest, writes its RAM and device state to the saved
+ * state file and makes QEMU quit. The guest picks up where it was when the
+ * file is fed back through '-incoming'; paused tells whether it was paused
+ * before, so it can be restored that way. QEMU runs as 'runAs' by now and
+ * cannot open files in the runtime directory, so we open the file and pass
+ * it over the monitor socket.
+ */
+func (monitor *QemuMonitor) SaveState(ctx context.Context, progress QemuJobProgress) (paused bool, err error) {
+	var client *QmpClient
+	var stateFile string = monitor.GetSavedStatePath()
+	var status QmpStatusInfo
+
+	file, err := os.OpenFile(stateFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		os.Remove(stateFile)
+		return false, err
+	}
+	defer client.Close()
+
+	err = client.Execute(ctx, QmpQueryStatusCommand, nil, &status)
+	if err == nil && status.Running {
+		log.Printf("[SaveState] pausing machine '%s'", monitor.Machine.Name)
+		err = client.Execute(ctx, QmpStopCommand, nil, nil)
+	}
+
+	if err == nil {
+		log.Printf("[SaveState] saving state of machine '%s' to '%s'", monitor.Machine.Name, stateFile)
+		err = client.SendFile(ctx, QemuSavedStateFdName, file)
+	}
+
+	if err == nil {
+		err = client.Execute(ctx, QmpMigrateCommand, map[string]string{
+			"uri": "fd:" + QemuSavedStateFdName,
+		}, nil)
+	}
+
+	if err == nil {
+		err = monitor.WaitMigration(ctx, client, false, progress)
+		if err != nil {
+			monitor.cancelMigration(client)
+		}
+	}
+
+	if err != nil {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), QmpDefaultTimeout)
+		defer cancel()
+
+		/* Leave the guest as it was: only resume it if we paused it */
+		if status.Running {
+			if _err := client.Execute(cleanupCtx, QmpContCommand, nil, nil); _err != nil {
+				log.Printf("[SaveState] could not resume machine '%s': %s", monitor.Machine.Name, _err.Error())
+			}
+		}
+		os.Remove(stateFile)
+		return false, err
+	}
+
+	/* QEMU serves one monitor client at a time */
+	client.Close()
+
+	return !status.Running, monitor.Quit(ctx)
+}
+
+/*
+ * FinishIncoming waits for QEMU to load an incoming migration and leaves the
+ * guest running or paused, as asked. QEMU runs the guest as soon as it is
+ * loaded unless it was started with StartPaused, so a guest that must stay
+ * paused needs that.
+ */
+func (monitor *QemuMonitor) FinishIncoming(ctx context.Context, running bool) (err error) {
+	var ticker *time.Ticker = time.NewTicker(QmpMigrationPollInterval)
+	defer ticker.Stop()
+
+	for {
+		status, err := monitor.QueryStatus(ctx)
+		if err != nil {
+			return err
+		}
+
+		if status.Status != QmpRunStateInMigrate {
+			log.Printf("[FinishIncoming] machine '%s' is '%s' after loading its state", monitor.Machine.Name, status.Status)
+
+			switch {
+			case status.Running == running:
+				return nil
+			case running:
+				return monitor.Resume(ctx)
+			default:
+				return monitor.Pause(ctx)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("incoming migration did not finish: %w", ctx.Err())
+		}
+	}
+}
+
+func setPostcopyCapability(ctx context.Context, client *QmpClient) error {
+	return client.Execute(ctx, QmpMigrateSetCapabilitiesCommand, map[string]interface{}{
+		"capabilities": []map[string]interface{}{
+			{"capability": QemuPostcopyRAMCapability, "state": true},
+		},
+	}, nil)
+}
+
+/*
+ * PrepareIncoming gets a QEMU launched with '-incoming unix:...' ready before
+ * the source connects: postcopy has to be enabled on both ends. The socket
+ * itself comes from the command line, as QEMU binds it before dropping
+ * privileges; after that it could not create it in the runtime directory.
+ */
+func (monitor *QemuMonitor) PrepareIncoming(ctx context.Context, postcopy bool) (err error) {
+	var client *QmpClient
+
+	if !postcopy {
+		return nil
+	}
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	log.Printf("[PrepareIncoming] enabling postcopy on machine '%s'", monitor.Machine.Name)
+	return setPostcopyCapability(ctx, client)
+}
+
+/* GetMigrationIncomingURI is where the destination QEMU listens for the guest */
+func (monitor *QemuMonitor) GetMigrationIncomingURI() string {
+	return "unix:" + monitor.GetMigrationSocketPath()
+}
+
+/*
+ * Migrate sends the guest to the QEMU listening on socketPath and waits for
+ * it to get there. The source QEMU cannot reach the destination's runtime
+ * directory as 'runAs', so we connect and hand it the connection.
+ */
+func (monitor *QemuMonitor) Migrate(ctx context.Context, socketPath string, postcopy bool, progress QemuJobProgress) (err error) {
+	var client *QmpClient
+	var dialer net.Dialer
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if postcopy {
+		if err = setPostcopyCapability(ctx, client); err != nil {
+			return err
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	/* QEMU gets a dup; ours is closed on return */
+	file, err := conn.(*net.UnixConn).File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err = client.SendFile(ctx, QemuMigrationFdName, file); err != nil {
+		return err
+	}
+
+	log.Printf("[Migrate] migrating machine '%s' to '%s'", monitor.Machine.Name, socketPath)
+	err = client.Execute(ctx, QmpMigrateCommand, map[string]string{"uri": "fd:" + QemuMigrationFdName}, nil)
+	if err != nil {
+		return err
+	}
+
+	err = monitor.WaitMigration(ctx, client, postcopy, progress)
+	if err != nil {
+		monitor.cancelMigration(client)
+	}
+
+	return err
+}
+
+/* AddHostForward adds a user network port forward (host -> guest) at runtime */
+func (monitor *QemuMonitor) AddHostForward(ctx context.Context, netdevID string, hostPort int, guestPort int) (err error) {
+	var client *QmpClient
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	output, err := client.HumanMonitorCommand(ctx, fmt.Sprintf("hostfwd_add %s tcp::%d-:%d", netdevID, hostPort, guestPort))
+	if err != nil {
+		return err
+	}
+
+	/* HMP commands report failures as plain output */
+	if output = strings.TrimSpace(output); len(output) > 0 {
+		return fmt.Errorf("hostfwd_add: %s", output)
+	}
+
+	return nil
+}
@@ -1,16 +1,17 @@
 package qemuctl_qemu
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
+	"os/user"
 	"strconv"
 	"strings"
 	"time"
 
+	config "github.com/lapuglisi/qemuctl/helpers"
 	runtime "github.com/lapuglisi/qemuctl/runtime"
 )
 
@@ -19,8 +20,10 @@ func init() {
 }
 
 const (
-	QemuMonitorSocketFileName string = "qemu-monitor.sock"
-	QemuMonitorDefaultID      string = "qemu-mon-qmp"
+	QemuMonitorSocketFileName  string = "qemu-monitor.sock"
+	QemuMonitorDefaultID       string = "qemu-mon-qmp"
+	QemuMonitorShutdownWait           = 60 * time.Second
+	QemuMonitorStopGracePeriod        = 10 * time.Second
 )
 
 type QemuMonitor struct {
@@ -33,36 +36,6 @@ func NewQemuMonitor(machine *runtime.Machine) *QemuMonitor {
 	}
 }
 
-func (monitor *QemuMonitor) ReadQmpHeader(unix net.Conn) (qmpHeader *QmpHeader, err error) {
-	const BufferSize = 1024
-
-	var dataBytes []byte = make([]byte, 0)
-	var buffer []byte = make([]byte, BufferSize)
-	var nBytes int = 0
-
-	qmpHeader = &QmpHeader{}
-
-	dataBytes = make([]byte, 0)
-	for nBytes, err = unix.Read(buffer); err == nil && nBytes > 0; {
-		dataBytes = append(dataBytes, buffer[:nBytes]...)
-		if nBytes < BufferSize {
-			break
-		}
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
-	/* Now that we have dataBytes, Unmarshal it to QmpHeader */
-	err = json.Unmarshal(dataBytes, qmpHeader)
-	if err != nil {
-		return nil, fmt.Errorf("json error: %s", err.Error())
-	}
-
-	return qmpHeader, nil
-}
-
 func (monitor *QemuMonitor) GetUnixSocketPath() string {
 	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuMonitorSocketFileName)
 }
@@ -81,6 +54,36 @@ func (monitor *QemuMonitor) GetPidFilePath() string {
 		monitor.Machine.RuntimeDirectory, runtime.RuntimeQemuPIDFileName)
 }
 
+/*
+ * ChownToRunAs gives path to the machine's 'runAs' user. QEMU drops its
+ * privileges to that user once started, so files it opens later (backup
+ * targets, for instance) must belong to it.
+ */
+func (monitor *QemuMonitor) ChownToRunAs(path string) (err error) {
+	configData, err := config.NewConfigHandler(monitor.Machine.ConfigFile).ParseConfigFile()
+	if err != nil {
+		return err
+	}
+
+	runAsUser, err := user.Lookup(configData.RunAs)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.Atoi(runAsUser.Uid)
+	if err != nil {
+		return err
+	}
+
+	gid, err := strconv.Atoi(runAsUser.Gid)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[ChownToRunAs] '%s' -> %s (%d:%d)", path, runAsUser.Username, uid, gid)
+	return os.Chown(path, uid, gid)
+}
+
 func (monitor *QemuMonitor) GetPidFromPidFile() (procPid int, err error) {
 	var filePath string = monitor.GetPidFilePath()
 	var fileData []byte
@@ -102,6 +105,26 @@ func (monitor *QemuMonitor) GetPidFromPidFile() (procPid int, err error) {
 	return procPid, nil
 }
 
+/*
+ * IsQemuProcess tells whether pid is still this machine's QEMU and not some
+ * other process that reused the pid; only our QEMU has our pidfile in its
+ * command line.
+ */
+func (monitor *QemuMonitor) IsQemuProcess(pid int) bool {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+
+	for _, argument := range strings.Split(string(cmdline), "\x00") {
+		if argument == monitor.GetPidFilePath() {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (monitor *QemuMonitor) WaitForPid() (procPid int, err error) {
 	var filePath string = monitor.GetPidFilePath()
 	var fileData []byte
@@ -144,96 +167,105 @@ func (monitor *QemuMonitor) WaitForPid() (procPid int, err error) {
 	return procPid, err
 }
 
-func (monitor *QemuMonitor) GetControlSocket() (unix net.Conn, err error) {
-	var qmpCommand QmpBasicCommand
-
-	log.Printf("[InitializeSocket] opening socket '%s'\n", monitor.GetUnixSocketPath())
-	{
-		unix, err = net.Dial("unix", monitor.GetUnixSocketPath())
-		if err != nil {
-			return nil, err
-		}
-	}
+func (monitor *QemuMonitor) GetControlSocket(ctx context.Context) (client *QmpClient, err error) {
+	var unix net.Conn
+	var dialer net.Dialer
 
-	log.Printf("[InitializeSocket] Reading QMP header")
-	{
-		_, err = monitor.ReadQmpHeader(unix)
-		if err != nil {
-			return nil, err
-		}
+	log.Printf("[GetControlSocket] opening socket '%s'\n", monitor.GetUnixSocketPath())
+	unix, err = dialer.DialContext(ctx, "unix", monitor.GetUnixSocketPath())
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("[initialize] enabling QMP capabilities")
-	qmpCommand.Command = QmpCapabilitiesCommand
-	_, err = qmpCommand.Execute(unix)
+	client, err = NewQmpClient(ctx, unix)
 	if err != nil {
+		unix.Close()
 		return nil, err
 	}
 
-	log.Printf("[InitializeSocket] socket initialized")
-	return unix, nil
+	log.Printf("[GetControlSocket] socket initialized")
+	return client, nil
 }
 
-func (monitor *QemuMonitor) QueryStatus() (result *QmpQueryStatusResult, err error) {
-	var unix net.Conn
-	var qmpCommand QmpCommandQueryStatus
+/*
+ * ExecuteCommand opens a QMP connection, runs a single command and closes it.
+ */
+func (monitor *QemuMonitor) ExecuteCommand(ctx context.Context, command string, arguments interface{}, result interface{}) (err error) {
+	var client *QmpClient
 
-	/* Initialize socket */
-	log.Printf("[QueryStatus] initializing socket\n")
-	unix, err = monitor.GetControlSocket()
+	client, err = monitor.GetControlSocket(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer client.Close()
+
+	return client.Execute(ctx, command, arguments, result)
+}
 
-	/* Create QueryStatus command and send it */
-	log.Printf("[QueryStatus] create query-status command\n")
-	result, err = qmpCommand.Execute(unix)
+func (monitor *QemuMonitor) Pause(ctx context.Context) error {
+	log.Printf("[Pause] pausing machine '%s'", monitor.Machine.Name)
+	return monitor.ExecuteCommand(ctx, QmpStopCommand, nil, nil)
+}
+
+func (monitor *QemuMonitor) Resume(ctx context.Context) error {
+	log.Printf("[Resume] resuming machine '%s'", monitor.Machine.Name)
+	return monitor.ExecuteCommand(ctx, QmpContCommand, nil, nil)
+}
+
+func (monitor *QemuMonitor) Reset(ctx context.Context) error {
+	log.Printf("[Reset] resetting machine '%s'", monitor.Machine.Name)
+	return monitor.ExecuteCommand(ctx, QmpSystemResetCommand, nil, nil)
+}
+
+func (monitor *QemuMonitor) Quit(ctx context.Context) (err error) {
+	log.Printf("[Quit] asking QEMU to quit machine '%s'", monitor.Machine.Name)
+	return monitor.ExecuteCommand(ctx, QmpQuitCommand, nil, nil)
+}
+
+func (monitor *QemuMonitor) QueryStatus(ctx context.Context) (status *QmpStatusInfo, err error) {
+	log.Printf("[QueryStatus] querying machine '%s'\n", monitor.Machine.Name)
+
+	status = &QmpStatusInfo{}
+	err = monitor.ExecuteCommand(ctx, QmpQueryStatusCommand, nil, status)
 	if err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	return status, nil
 }
 
-func (monitor *QemuMonitor) SendShutdownCommand() (err error) {
-	var unix net.Conn
-	var shutdownCommand QmpBasicCommand
-	var basicResult *QmpBasicResult
+func (monitor *QemuMonitor) SendShutdownCommand(ctx context.Context) (err error) {
+	var client *QmpClient
+	var subscription *QmpEventSubscription
 
 	log.Printf("[SendShutdownCommand] initializing socket")
-	unix, err = monitor.GetControlSocket()
+	client, err = monitor.GetControlSocket(ctx)
 	if err != nil {
 		return err
 	}
-	defer unix.Close()
+	defer client.Close()
+
+	subscription = client.Subscribe("SHUTDOWN")
+	defer subscription.Close()
 
 	log.Printf("[SendShutdownCommand] sending shutdown command")
-	shutdownCommand = QmpBasicCommand{
-		Command: QmpSystemPowerdownCommand,
-	}
-	basicResult, err = shutdownCommand.Execute(unix)
+	err = client.Execute(ctx, QmpSystemPowerdownCommand, nil, nil)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("[SendShutdownCommand] got QmpBasicResult [%v]", basicResult)
-
-	/* Now read incoming events */
-	err = nil
-	log.Printf("[SendShutdownCommand] reading incoming events")
-	qmpEvent := QmpEventResult{}
-	for {
-		err = qmpEvent.ReadEvent(unix)
-		if err != nil {
-			break
+	/* Now wait for SHUTDOWN or for QEMU to close the socket (i.e. exit) */
+	log.Printf("[SendShutdownCommand] waiting for SHUTDOWN event")
+	select {
+	case event, ok := <-subscription.Events:
+		if ok {
+			log.Printf("[SendShutdownCommand] event received: %s", event.String())
+		} else {
+			log.Printf("[SendShutdownCommand] connection closed by QEMU")
 		}
-		log.Printf("[SendShutdownCommand] event received: %v", qmpEvent)
-	}
-
-	if err != nil && err == io.EOF {
-		log.Printf("[monitor] ReadEvent returned err == EOF; ignoring")
-		err = nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	return err
+	return nil
 }
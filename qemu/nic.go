@@ -0,0 +1,288 @@
+package qemuctl_qemu
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+const (
+	QemuNicTypeUser     string = "user"
+	QemuNicTypeBridge   string = "bridge"
+	QemuNicTypeTap      string = "tap"
+	QemuNicDefaultModel string = "virtio-net-pci"
+	QemuNicDeviceSuffix string = "-nic"
+
+	QmpNetdevAddCommand string = "netdev_add"
+	QmpNetdevDelCommand string = "netdev_del"
+)
+
+// QemuNic describes a network backend (netdev) and the guest NIC using it
+type QemuNic struct {
+	ID           string
+	Type         string
+	Model        string
+	MacAddress   string
+	Bridge       string
+	Helper       string
+	TapInterface string
+}
+
+func (nic *QemuNic) DeviceID() string {
+	return nic.ID + QemuNicDeviceSuffix
+}
+
+func (nic *QemuNic) Validate() error {
+	if len(nic.ID) == 0 {
+		return fmt.Errorf("nic id is mandatory")
+	}
+
+	switch nic.Type {
+	case QemuNicTypeUser, QemuNicTypeBridge, QemuNicTypeTap:
+	default:
+		return fmt.Errorf("unsupported nic type '%s'", nic.Type)
+	}
+
+	return nil
+}
+
+/* QMP arguments for netdev_add */
+func (nic *QemuNic) NetdevArguments() map[string]interface{} {
+	arguments := map[string]interface{}{
+		"type": nic.Type,
+		"id":   nic.ID,
+	}
+
+	switch nic.Type {
+	case QemuNicTypeBridge:
+		{
+			if len(nic.Bridge) > 0 {
+				arguments["br"] = nic.Bridge
+			}
+			if len(nic.Helper) > 0 {
+				arguments["helper"] = nic.Helper
+			}
+		}
+	case QemuNicTypeTap:
+		{
+			if len(nic.TapInterface) > 0 {
+				arguments["ifname"] = nic.TapInterface
+			}
+			arguments["script"] = "no"
+			arguments["downscript"] = "no"
+		}
+	}
+
+	return arguments
+}
+
+/* QMP arguments for device_add */
+func (nic *QemuNic) DeviceArguments() map[string]interface{} {
+	return map[string]interface{}{
+		"driver": nic.Model,
+		"id":     nic.DeviceID(),
+		"netdev": nic.ID,
+		"mac":    nic.MacAddress,
+	}
+}
+
+func (monitor *QemuMonitor) AddNic(ctx context.Context, nic *QemuNic) (err error) {
+	var client *QmpClient
+
+	if err = nic.Validate(); err != nil {
+		return err
+	}
+
+	if len(nic.Model) == 0 {
+		nic.Model = QemuNicDefaultModel
+	}
+
+	if len(nic.MacAddress) == 0 {
+		if nic.MacAddress, err = GenerateQemuMacAddress(); err != nil {
+			return err
+		}
+	}
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	log.Printf("[AddNic] adding %s netdev '%s'", nic.Type, nic.ID)
+	err = client.Execute(ctx, QmpNetdevAddCommand, nic.NetdevArguments(), nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[AddNic] adding %s device '%s' (%s)", nic.Model, nic.DeviceID(), nic.MacAddress)
+	err = client.Execute(ctx, QmpDeviceAddCommand, nic.DeviceArguments(), nil)
+	if err != nil {
+		/* Do not leave an orphan netdev behind */
+		if _err := client.Execute(ctx, QmpNetdevDelCommand, map[string]string{"id": nic.ID}, nil); _err != nil {
+			log.Printf("[AddNic] could not remove netdev '%s': %s", nic.ID, _err.Error())
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (monitor *QemuMonitor) RemoveNic(ctx context.Context, nicID string) (err error) {
+	var client *QmpClient
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = monitor.removeDevice(ctx, client, nicID+QemuNicDeviceSuffix); err != nil {
+		return err
+	}
+
+	log.Printf("[RemoveNic] removing netdev '%s'", nicID)
+	return client.Execute(ctx, QmpNetdevDelCommand, map[string]string{"id": nicID}, nil)
+}
+
+/*
+ * QueryNetworkInfo returns HMP's 'info network' lines, which describe every
+ * NIC along with the backend it is plugged to.
+ */
+func (monitor *QemuMonitor) QueryNetworkInfo(ctx context.Context) (lines []string, err error) {
+	var client *QmpClient
+	var output string
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	output, err = client.HumanMonitorCommand(ctx, "info network")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimRight(line, "\r "); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, nil
+}
+
+/* QemuHostForward is a user network port forward as reported by 'info usernet' */
+type QemuHostForward struct {
+	Protocol     string
+	HostAddress  string
+	HostPort     int
+	GuestAddress string
+	GuestPort    int
+}
+
+func (forward QemuHostForward) String() string {
+	return fmt.Sprintf("%d->%d/%s", forward.HostPort, forward.GuestPort, strings.ToLower(forward.Protocol))
+}
+
+/* QueryUserNet returns the host forwards and guest addresses of the user network */
+func (monitor *QemuMonitor) QueryUserNet(ctx context.Context) (forwards []QemuHostForward, guestAddresses []string, err error) {
+	var client *QmpClient
+	var output string
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer client.Close()
+
+	output, err = client.HumanMonitorCommand(ctx, "info usernet")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	forwards, guestAddresses = parseUserNet(output)
+	return forwards, guestAddresses, nil
+}
+
+/*
+ * parseUserNet parses HMP's 'info usernet' socket table:
+ *   Protocol[State]    FD  Source Address  Port   Dest. Address  Port RecvQ SendQ
+ *   TCP[HOST_FORWARD]  13               *  2222       10.0.2.15    22     0     0
+ *   UDP[236 sec]       25       10.0.2.15 52311        10.0.2.3    53     0     0
+ * Forwards list the guest as destination; other sockets were opened by the
+ * guest and list it as source.
+ */
+func parseUserNet(output string) (forwards []QemuHostForward, guestAddresses []string) {
+	var seen map[string]bool = make(map[string]bool)
+
+	addGuestAddress := func(address string) {
+		if address != "*" && !seen[address] {
+			seen[address] = true
+			guestAddresses = append(guestAddresses, address)
+		}
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		var forward QemuHostForward
+		var state string
+
+		fields := strings.Fields(line)
+		/* UDP states carry a timeout, e.g. "UDP[236 sec]" */
+		if len(fields) == 9 && strings.Contains(fields[0], "[") && !strings.Contains(fields[0], "]") {
+			fields = append([]string{fields[0] + " " + fields[1]}, fields[2:]...)
+		}
+		if len(fields) != 8 || !strings.Contains(fields[0], "[") {
+			continue
+		}
+
+		forward.Protocol, state, _ = strings.Cut(strings.TrimSuffix(fields[0], "]"), "[")
+		if _, err := fmt.Sscanf(fields[3], "%d", &forward.HostPort); err != nil {
+			continue
+		}
+		if _, err := fmt.Sscanf(fields[5], "%d", &forward.GuestPort); err != nil {
+			continue
+		}
+
+		if state == "HOST_FORWARD" {
+			forward.HostAddress = fields[2]
+			forward.GuestAddress = fields[4]
+			forwards = append(forwards, forward)
+			addGuestAddress(forward.GuestAddress)
+		} else {
+			addGuestAddress(fields[2])
+		}
+	}
+
+	return forwards, guestAddresses
+}
+
+/*
+ * GuestIPAddresses asks the guest agent for the guest's addresses and falls
+ * back to what the user network has seen when there is no agent.
+ */
+func (monitor *QemuMonitor) GuestIPAddresses(ctx context.Context) (addresses []string, err error) {
+	agentCtx, cancel := context.WithTimeout(ctx, QgaQuickTimeout)
+	defer cancel()
+
+	interfaces, err := monitor.GuestNetworkInterfaces(agentCtx)
+	if err == nil {
+		for _, guestInterface := range interfaces {
+			for _, address := range guestInterface.IPAddresses {
+				ip := net.ParseIP(address.Address)
+				if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+					continue
+				}
+				addresses = append(addresses, address.Address)
+			}
+		}
+		return addresses, nil
+	}
+	log.Printf("[GuestIPAddresses] guest agent of '%s' unavailable (%s), trying usernet", monitor.Machine.Name, err.Error())
+
+	_, addresses, err = monitor.QueryUserNet(ctx)
+	return addresses, err
+}
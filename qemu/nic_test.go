@@ -0,0 +1,85 @@
+package qemuctl_qemu
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUserNet(t *testing.T) {
+	tests := []struct {
+		name          string
+		output        string
+		wantForwards  []QemuHostForward
+		wantAddresses []string
+	}{
+		{
+			name: "forwards and guest sockets",
+			output: "Hub -1 (net0):\r\n" +
+				"  Protocol[State]    FD  Source Address  Port   Dest. Address  Port RecvQ SendQ\r\n" +
+				"  TCP[HOST_FORWARD]  13               *  2222       10.0.2.15    22     0     0\r\n" +
+				"  UDP[HOST_FORWARD]  14       127.0.0.1  5353       10.0.2.15    53     0     0\r\n" +
+				"  TCP[ESTABLISHED]   22       10.0.2.16 45678   93.184.216.34   443     0     0\r\n" +
+				"  UDP[236 sec]       25       10.0.2.17 52311        10.0.2.3    53     0     0\r\n",
+			wantForwards: []QemuHostForward{
+				{Protocol: "TCP", HostAddress: "*", HostPort: 2222, GuestAddress: "10.0.2.15", GuestPort: 22},
+				{Protocol: "UDP", HostAddress: "127.0.0.1", HostPort: 5353, GuestAddress: "10.0.2.15", GuestPort: 53},
+			},
+			wantAddresses: []string{"10.0.2.15", "10.0.2.16", "10.0.2.17"},
+		},
+		{
+			name: "listening guest socket has no source",
+			output: "  Protocol[State]    FD  Source Address  Port   Dest. Address  Port RecvQ SendQ\n" +
+				"  TCP[SYN_SYNT]      30               *     0        10.0.2.2    80     0     0\n",
+		},
+		{
+			name: "several hubs",
+			output: "Hub 0 (user0):\n" +
+				"  Protocol[State]    FD  Source Address  Port   Dest. Address  Port RecvQ SendQ\n" +
+				"  TCP[HOST_FORWARD]  13               *  8080       10.0.2.15    80     0     0\n" +
+				"Hub 1 (user1):\n" +
+				"  Protocol[State]    FD  Source Address  Port   Dest. Address  Port RecvQ SendQ\n" +
+				"  TCP[HOST_FORWARD]  15       127.0.0.1  8443      10.0.3.15   443     0     0\n",
+			wantForwards: []QemuHostForward{
+				{Protocol: "TCP", HostAddress: "*", HostPort: 8080, GuestAddress: "10.0.2.15", GuestPort: 80},
+				{Protocol: "TCP", HostAddress: "127.0.0.1", HostPort: 8443, GuestAddress: "10.0.3.15", GuestPort: 443},
+			},
+			wantAddresses: []string{"10.0.2.15", "10.0.3.15"},
+		},
+		{
+			name: "malformed lines are skipped",
+			output: "  TCP[HOST_FORWARD]  13               *  ssh       10.0.2.15    22     0     0\n" +
+				"  TCP[HOST_FORWARD]  13               *  2222       10.0.2.15    22     0\n" +
+				"  TCP                13               *  2222       10.0.2.15    22     0     0\n",
+		},
+		{
+			name: "no user network",
+		},
+	}
+
+	for _, test := range tests {
+		forwards, addresses := parseUserNet(test.output)
+
+		if !reflect.DeepEqual(forwards, test.wantForwards) {
+			t.Errorf("%s: got forwards %v, want %v", test.name, forwards, test.wantForwards)
+		}
+		if !reflect.DeepEqual(addresses, test.wantAddresses) {
+			t.Errorf("%s: got addresses %v, want %v", test.name, addresses, test.wantAddresses)
+		}
+	}
+}
+
+func TestHostForwardString(t *testing.T) {
+	tests := []struct {
+		forward QemuHostForward
+		want    string
+	}{
+		{QemuHostForward{Protocol: "TCP", HostPort: 2222, GuestPort: 22}, "2222->22/tcp"},
+		{QemuHostForward{Protocol: "UDP", HostAddress: "127.0.0.1", HostPort: 5353, GuestPort: 53}, "5353->53/udp"},
+	}
+
+	for _, test := range tests {
+		if got := test.forward.String(); got != test.want {
+			t.Errorf("got '%s', want '%s'", got, test.want)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	//"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -25,6 +26,9 @@ type QemuCommand struct {
 	QemuPath      string
 	Configuration *config.ConfigurationData
 	Monitor       *QemuMonitor
+	IncomingURI   string // when set, QEMU waits for the guest state on this URI
+	StartPaused   bool   // do not run the guest until told to ('-S')
+	NoHostForward bool   // leave user network port forwards out, they are added later
 }
 
 var nodeDevices []string = []string{"xvda", "xvdb", "xvdc"}
@@ -50,6 +54,10 @@ func NewQemuCommand(configData *config.ConfigurationData, qemuMonitor *QemuMonit
 }
 
 func (qemu *QemuCommand) generateQemuMacAdress() (mac string, err error) {
+	return GenerateQemuMacAddress()
+}
+
+func GenerateQemuMacAddress() (mac string, err error) {
 	/* QEMU usually sets a mac address in the form '52:54:00:XX:XX:XX', so i'm sticking to it */
 	var macBytes []byte = make([]byte, 3)
 
@@ -155,15 +163,33 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 	}
 
 	// -- Memory
-	qemuArgs = qemu.appendQemuArg(qemuArgs, "-m", cd.Memory)
+	memorySpec := cd.Memory
+	if len(cd.MaxMemory) > 0 {
+		/* room for hot-plugged memory */
+		memorySpec = fmt.Sprintf("size=%s,maxmem=%s%s", cd.Memory, cd.MaxMemory,
+			qemu.getKeyValuePair(cd.MemorySlots > 0, ",slots", fmt.Sprintf("%d", cd.MemorySlots)))
+	}
+	qemuArgs = qemu.appendQemuArg(qemuArgs, "-m", memorySpec)
+
+	// -- Memory balloon
+	if cd.Balloon.Enabled {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", GetBalloonDeviceSpec(cd.Balloon.FreePageReporting))
+	}
 
 	// -- cpus
 	cpuSpec := fmt.Sprintf("%d,sockets=1,threads=1", cd.CPUs)
+	if cd.MaxCPUs > cd.CPUs {
+		/* room for hot-plugged vCPUs */
+		cpuSpec = fmt.Sprintf("%d,maxcpus=%d,sockets=1,threads=1", cd.CPUs, cd.MaxCPUs)
+	}
 	qemuArgs = qemu.appendQemuArg(qemuArgs, "-smp", cpuSpec)
 
 	// -- CDROM
-	if len(cd.Disks.ISOCDrom) > 0 {
-		qemuArgs = qemu.appendQemuArg(qemuArgs, "-cdrom", cd.Disks.ISOCDrom)
+	if len(cd.Disks.ISOCDrom) > 0 || cd.Disks.CDRomDrive {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-drive", GetCDRomDriveSpec(cd.Disks.ISOCDrom))
+		/* 'd' is the CD-ROM in '-boot order', which only applies without a kernel or boot menu */
+		cdromFirst := len(cd.Boot.KernelPath) == 0 && !cd.Boot.EnableBootMenu && strings.HasPrefix(cd.Boot.BootOrder, "d")
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", GetCDRomDeviceSpec(cdromFirst))
 	}
 
 	/*
@@ -179,7 +205,12 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 	 * Display specification
 	 */
 	if !cd.Display.EnableGraphics {
-		qemuArgs = append(qemuArgs, "-nographic")
+		/* -nographic would put the serial port on our stdio */
+		if cd.Serial.Enabled {
+			qemuArgs = qemu.appendQemuArg(qemuArgs, "-display", "none")
+		} else {
+			qemuArgs = append(qemuArgs, "-nographic")
+		}
 	} else {
 		// -- VGA
 		qemuArgs = qemu.appendQemuArg(qemuArgs, "-vga", cd.Display.VGAType)
@@ -289,12 +320,15 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 				netSpec = fmt.Sprintf("%s,net=%s", netSpec, cd.Net.User.IPSubnet)
 			}
 
-			if cd.SSH.LocalPort > 0 {
+			if cd.SSH.LocalPort > 0 && !qemu.NoHostForward {
 				netSpec = fmt.Sprintf("%s,hostfwd=tcp::%d-:22", netSpec, cd.SSH.LocalPort)
 			}
 
 			/* Port fowards come here */
 			for _, _value := range cd.Net.User.PortForwards {
+				if qemu.NoHostForward {
+					break
+				}
 				netSpec = fmt.Sprintf("%s,hostfwd=tcp::%d-:%d", netSpec, _value.HostPort, _value.GuestPort)
 			}
 
@@ -307,7 +341,12 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 		if cd.Net.Bridge.Enabled {
 			//-- Device specification
 			for _, bridge := range cd.Net.Bridge.Interfaces {
-				netSpec = fmt.Sprintf("virtio-net-pci,netdev=%s", bridge.ID)
+				model := bridge.Model
+				if len(model) == 0 {
+					model = QemuNicDefaultModel
+				}
+
+				netSpec = fmt.Sprintf("%s,netdev=%s,id=%s%s", model, bridge.ID, bridge.ID, QemuNicDeviceSuffix)
 				if len(bridge.MacAddress) > 0 {
 					netSpec = fmt.Sprintf("%s,mac=%s", netSpec, bridge.MacAddress)
 				} else {
@@ -399,7 +438,41 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 	}
 
 	// -- Disk images list
+	scsiController := false
 	for _, image := range cd.Disks.Images {
+		/* External snapshots: open the top of the overlay chain instead */
+		if imagePath, err := filepath.Abs(image.File); err == nil {
+			if activeImage, isOverlay := machine.GetActiveDiskImage(imagePath); isOverlay {
+				log.Printf("[qemuArgs] using overlay '%s' for image '%s'", activeImage, image.File)
+				image.File = activeImage
+				image.Format = QemuDiskFormatQcow2
+			}
+		}
+
+		if len(image.ID) > 0 {
+			/* Images with an id use -blockdev/-device so they can be detached at runtime */
+			disk := QemuDisk{
+				ID:      image.ID,
+				File:    image.File,
+				Format:  runtime.GetValueOrDefault(image.Format, QemuDiskFormatRaw),
+				Bus:     runtime.GetValueOrDefault(image.Interface, QemuDiskBusVirtio),
+				Discard: cd.Machine.WindowsVM,
+			}
+			if err = disk.Validate(); err != nil {
+				return nil, err
+			}
+
+			if disk.Bus == QemuDiskBusSCSI && !scsiController {
+				qemuArgs = qemu.appendQemuArg(qemuArgs, "-device",
+					fmt.Sprintf("virtio-scsi-pci,id=%s", QemuDiskSCSIControllerID))
+				scsiController = true
+			}
+
+			qemuArgs = qemu.appendQemuArg(qemuArgs, "-blockdev", disk.BlockdevSpec())
+			qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", disk.DeviceSpec())
+			continue
+		}
+
 		driveMedia := "disk"
 		driveIf := "ide"
 		if len(image.Interface) > 0 {
@@ -428,9 +501,31 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 	qemuArgs = qemu.appendQemuArg(qemuArgs, "-chardev", monitor.GetChardevSpec())
 	qemuArgs = qemu.appendQemuArg(qemuArgs, "-qmp", monitor.GetMonitorSpec())
 
+	/* Guest agent channel */
+	if cd.GuestAgent.Enabled {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-chardev", monitor.GetGuestAgentChardevSpec())
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", GetVirtioSerialDeviceSpec())
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", GetGuestAgentPortSpec())
+	}
+
+	/* Serial console, reachable with 'qemuctl console' */
+	if cd.Serial.Enabled {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-chardev", monitor.GetSerialChardevSpec())
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-serial", GetSerialSpec())
+	}
+
 	/* Add PIDfile spec */
 	qemuArgs = qemu.appendQemuArg(qemuArgs, "-pidfile", monitor.GetPidFilePath())
 
+	/* Load the guest state instead of booting */
+	if len(qemu.IncomingURI) > 0 {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-incoming", qemu.IncomingURI)
+	}
+
+	if qemu.StartPaused {
+		qemuArgs = append(qemuArgs, "-S")
+	}
+
 	return qemuArgs, nil
 }
 
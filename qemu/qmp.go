@@ -1,10 +1,18 @@
 package qemuctl_qemu
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -12,9 +20,31 @@ const (
 	QmpCapabilitiesCommand    string = "qmp_capabilities"
 	QmpQueryStatusCommand     string = "query-status"
 	QmpSystemPowerdownCommand string = "system_powerdown"
-	QmpDefaultBufferSize      int    = 1024
+	QmpSystemResetCommand     string = "system_reset"
+	QmpQuitCommand            string = "quit"
+	QmpStopCommand            string = "stop"
+	QmpContCommand            string = "cont"
+	QmpHumanMonitorCommand    string = "human-monitor-command"
+	QmpQueryCommandsCommand   string = "query-commands"
+	QmpGetFdCommand           string = "getfd"
+	QmpAddFdCommand           string = "add-fd"
+	QmpRemoveFdCommand        string = "remove-fd"
+	QmpRunStatePaused         string = "paused"
+	QmpEventBufferSize        int    = 64
+	QmpDefaultTimeout                = 10 * time.Second
 )
 
+/* QMP error classes, as sent by QEMU in the 'class' member of an error reply */
+const (
+	QmpErrorClassGenericError    string = "GenericError"
+	QmpErrorClassCommandNotFound string = "CommandNotFound"
+	QmpErrorClassDeviceNotActive string = "DeviceNotActive"
+	QmpErrorClassDeviceNotFound  string = "DeviceNotFound"
+	QmpErrorClassKVMMissingCap   string = "KVMMissingCap"
+)
+
+var ErrQmpClosed = errors.New("qmp connection closed")
+
 type QmpHeaderVersionQemu struct {
 	Micro int `json:"micro"`
 	Minor int `json:"minor"`
@@ -27,174 +57,441 @@ type QmpHeaderVersionData struct {
 
 type QmpHeader struct {
 	QMP struct {
-		Version QmpHeaderVersionData `json:"version"`
-		Package string               `json:"package"`
+		Version      QmpHeaderVersionData `json:"version"`
+		Package      string               `json:"package"`
+		Capabilities []string             `json:"capabilities"`
 	} `json:"QMP"`
 }
 
-type QmpCommandArguments struct {
-	Device string `json:"device"`
+type QmpStatusInfo struct {
+	Status     string `json:"status"`
+	SingleStep bool   `json:"singlestep"`
+	Running    bool   `json:"running"`
 }
 
-type QmpBasicCommand struct {
-	Command string `json:"execute"`
+type QmpTimestamp struct {
+	Seconds      int64 `json:"seconds"`
+	Microseconds int64 `json:"microseconds"`
 }
 
-type QmpCommandQueryStatus struct {
-	Command string `json:"execute"`
+type QmpEvent struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp QmpTimestamp    `json:"timestamp"`
 }
 
-type QmpQueryStatusResult struct {
-	Return struct {
-		Status     string `json:"status"`
-		SingleStep bool   `json:"singlestep"`
-		Running    bool   `json:"running"`
-	} `json:"return"`
+// QmpError is the Go form of a QMP error reply
+type QmpError struct {
+	Class       string `json:"class"`
+	Description string `json:"desc"`
 }
 
-type QmpQueryStatusReturn struct {
-	Return QmpQueryStatusResult `json:"result"`
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        string      `json:"id"`
 }
 
-type QmpBasicResult struct {
-	Result interface{} `json:"result"`
+/* qmpMessage is anything QEMU may send us: a reply, an error or an event */
+type qmpMessage struct {
+	ID        string          `json:"id"`
+	Return    json.RawMessage `json:"return"`
+	Error     *QmpError       `json:"error"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp QmpTimestamp    `json:"timestamp"`
 }
 
-type QmpEventResult struct {
-	Result struct {
-		Timestamp struct {
-			Seconds      int64 `json:"seconds"`
-			Microseconds int   `json:"microseconds"`
-		} `json:"timestamp"`
-		Event string      `json:"event"`
-		Data  interface{} `json:"data"`
-	} `json:"result"`
+type QmpEventSubscription struct {
+	Events  chan *QmpEvent
+	filter  map[string]bool
+	client  *QmpClient
+	dropped uint64
 }
 
-func (command *QmpBasicCommand) Execute(socket net.Conn) (result *QmpBasicResult, err error) {
-	var jsonBytes []byte
-	var buffer []byte = make([]byte, QmpDefaultBufferSize)
-	var nBytes int
+// QmpClient speaks QMP over a single monitor connection. Replies are
+// matched to commands by id and events are routed to subscribers.
+type QmpClient struct {
+	Header *QmpHeader
+
+	conn          net.Conn
+	writeLock     sync.Mutex
+	lock          sync.Mutex
+	nextID        uint64
+	pending       map[string]chan *qmpMessage
+	subscriptions []*QmpEventSubscription
+	done          chan struct{}
+	err           error
+}
 
-	result = &QmpBasicResult{}
+func (e *QmpError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Description, e.Class)
+}
 
-	/* Marshal struct into bytes */
-	log.Printf("[QmpCommand] execute: creating json bytes")
-	jsonBytes, err = json.Marshal(command)
+func IsQmpErrorClass(err error, class string) bool {
+	var qmpError *QmpError
+
+	if errors.As(err, &qmpError) {
+		return qmpError.Class == class
+	}
+
+	return false
+}
+
+func (timestamp QmpTimestamp) Time() time.Time {
+	return time.Unix(timestamp.Seconds, timestamp.Microseconds*1000)
+}
+
+func (event *QmpEvent) String() string {
+	var data string = ""
+
+	if len(event.Data) > 0 {
+		data = " " + string(event.Data)
+	}
+
+	return fmt.Sprintf("%s %s%s",
+		event.Timestamp.Time().Format("2006-01-02 15:04:05.000000"), event.Event, data)
+}
+
+/*
+ * NewQmpClient reads the QMP greeting from conn, starts the background reader
+ * and leaves capabilities negotiation mode, so the client is ready for commands.
+ */
+func NewQmpClient(ctx context.Context, conn net.Conn) (client *QmpClient, err error) {
+	var reader *bufio.Reader = bufio.NewReader(conn)
+	var line []byte
+
+	client = &QmpClient{
+		Header:  &QmpHeader{},
+		conn:    conn,
+		pending: make(map[string]chan *qmpMessage),
+		done:    make(chan struct{}),
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+
+	log.Printf("[QmpClient] reading QMP greeting")
+	line, err = reader.ReadBytes('\n')
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("[QmpCommand] execute: json bytes is [%s]", string(jsonBytes))
+	if err = json.Unmarshal(line, client.Header); err != nil {
+		return nil, fmt.Errorf("invalid QMP greeting: %s", err.Error())
+	}
 
-	/* Send command data to socket */
-	log.Printf("[QmpCommand] execute: sending command to socket")
-	_, err = socket.Write(jsonBytes)
-	if err != nil {
+	conn.SetReadDeadline(time.Time{})
+
+	log.Printf("[QmpClient] connected to QEMU %d.%d.%d",
+		client.Header.QMP.Version.Qemu.Major,
+		client.Header.QMP.Version.Qemu.Minor,
+		client.Header.QMP.Version.Qemu.Micro)
+
+	go client.readLoop(reader)
+
+	log.Printf("[QmpClient] enabling QMP capabilities")
+	if err = client.Execute(ctx, QmpCapabilitiesCommand, nil, nil); err != nil {
+		client.Close()
 		return nil, err
 	}
 
-	/* Read return JSON from socket */
-	log.Printf("[QmpCommand] execute: reading result from socket")
-	jsonBytes = make([]byte, 0)
+	return client, nil
+}
+
+func (client *QmpClient) readLoop(reader *bufio.Reader) {
+	var err error
+	var line []byte
+
+	for {
+		line, err = reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			client.dispatch(line)
+		}
 
-	for nBytes, err = socket.Read(buffer); err == nil && nBytes > 0; {
-		jsonBytes = append(jsonBytes, buffer[:nBytes]...)
-		if nBytes < QmpDefaultBufferSize {
+		if err != nil {
 			break
 		}
 	}
 
-	/* Unmarshal jsonBytes into result */
-	err = json.Unmarshal(jsonBytes, &result)
+	log.Printf("[QmpClient] reader finished: %s", err.Error())
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		err = ErrQmpClosed
+	}
 
-	log.Printf("[QmpCommand] execute: result is [%v]", result)
+	client.lock.Lock()
+	client.err = err
+	for _, subscription := range client.subscriptions {
+		close(subscription.Events)
+	}
+	client.subscriptions = nil
+	client.lock.Unlock()
 
-	return result, err
+	close(client.done)
 }
 
-func (command *QmpCommandQueryStatus) Execute(socket net.Conn) (result *QmpQueryStatusResult, err error) {
-	var jsonBytes []byte
-	var buffer []byte = make([]byte, QmpDefaultBufferSize)
-	var nBytes int
+func (client *QmpClient) dispatch(line []byte) {
+	var message *qmpMessage = &qmpMessage{}
+
+	if err := json.Unmarshal(line, message); err != nil {
+		log.Printf("[QmpClient] discarding invalid message [%s]: %s", string(line), err.Error())
+		return
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if len(message.Event) > 0 {
+		event := &QmpEvent{
+			Event:     message.Event,
+			Data:      message.Data,
+			Timestamp: message.Timestamp,
+		}
+
+		log.Printf("[QmpClient] event received: %s", event.String())
+		for _, subscription := range client.subscriptions {
+			if subscription.filter != nil && !subscription.filter[event.Event] {
+				continue
+			}
+
+			select {
+			case subscription.Events <- event:
+			default:
+				subscription.dropped++
+				log.Printf("[QmpClient] subscriber queue full; dropping event %s", event.Event)
+			}
+		}
+		return
+	}
+
+	replyChannel, ok := client.pending[message.ID]
+	if !ok {
+		log.Printf("[QmpClient] discarding reply with unknown id [%s]", string(line))
+		return
+	}
+
+	delete(client.pending, message.ID)
+	replyChannel <- message
+}
+
+/*
+ * Execute sends command with arguments (which may be nil) and waits for its
+ * reply. If result is not nil, the 'return' member of the reply is decoded into it.
+ */
+func (client *QmpClient) Execute(ctx context.Context, command string, arguments interface{}, result interface{}) (err error) {
+	return client.execute(ctx, command, arguments, result, nil)
+}
+
+/*
+ * SendFile hands an open file to QEMU under fdName ('getfd'), so QEMU can use
+ * files it would have no permission to open itself after dropping privileges.
+ */
+func (client *QmpClient) SendFile(ctx context.Context, fdName string, file *os.File) (err error) {
+	if _, ok := client.conn.(*net.UnixConn); !ok {
+		return fmt.Errorf("file descriptors can only be passed over a unix socket")
+	}
 
-	result = &QmpQueryStatusResult{}
+	return client.execute(ctx, QmpGetFdCommand, map[string]string{"fdname": fdName}, nil, syscall.UnixRights(int(file.Fd())))
+}
 
-	/* Marshal struct into bytes */
-	log.Printf("[QmpCommandQuery] execute: creating json bytes")
+/*
+ * AddFileToFdSet hands an open file to QEMU in a new fd set ('add-fd').
+ * Commands that take a file name accept "/dev/fdset/ID" for it, as long as
+ * the file was opened with the access mode QEMU asks for.
+ */
+func (client *QmpClient) AddFileToFdSet(ctx context.Context, file *os.File) (fdSetID int64, err error) {
+	var result struct {
+		FdSetID int64 `json:"fdset-id"`
+	}
 
-	command.Command = QmpQueryStatusCommand
+	if _, ok := client.conn.(*net.UnixConn); !ok {
+		return 0, fmt.Errorf("file descriptors can only be passed over a unix socket")
+	}
 
-	jsonBytes, err = json.Marshal(command)
+	err = client.execute(ctx, QmpAddFdCommand, nil, &result, syscall.UnixRights(int(file.Fd())))
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	log.Printf("[QmpCommandQuery] execute: json bytes is [%s]", string(jsonBytes))
+	return result.FdSetID, nil
+}
 
-	/* Send command data to socket */
-	log.Printf("[QmpCommandQuery] execute: sending command to socket")
-	_, err = socket.Write(jsonBytes)
+/* RemoveFdSet closes QEMU's copies of the files in an fd set */
+func (client *QmpClient) RemoveFdSet(ctx context.Context, fdSetID int64) (err error) {
+	return client.Execute(ctx, QmpRemoveFdCommand, map[string]int64{"fdset-id": fdSetID}, nil)
+}
+
+/* execute sends the command along with oob (ancillary) data, if any */
+func (client *QmpClient) execute(ctx context.Context, command string, arguments interface{}, result interface{}, oob []byte) (err error) {
+	var jsonBytes []byte
+	var message *qmpMessage
+	var replyChannel chan *qmpMessage = make(chan *qmpMessage, 1)
+
+	client.lock.Lock()
+	if client.err != nil {
+		client.lock.Unlock()
+		return client.err
+	}
+	client.nextID++
+	commandID := fmt.Sprintf("qemuctl-%d", client.nextID)
+	client.pending[commandID] = replyChannel
+	client.lock.Unlock()
+
+	defer func() {
+		client.lock.Lock()
+		delete(client.pending, commandID)
+		client.lock.Unlock()
+	}()
+
+	jsonBytes, err = json.Marshal(qmpCommand{
+		Execute:   command,
+		Arguments: arguments,
+		ID:        commandID,
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	/* Read return JSON from socket */
-	log.Printf("[QmpCommandQuery] execute: reading result from socket")
-	jsonBytes = make([]byte, 0)
+	log.Printf("[QmpClient] sending [%s]", string(jsonBytes))
 
-	for nBytes, err = socket.Read(buffer); err == nil && nBytes > 0; {
-		jsonBytes = append(jsonBytes, buffer[:nBytes]...)
-		if nBytes < QmpDefaultBufferSize {
-			break
+	client.writeLock.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		client.conn.SetWriteDeadline(deadline)
+	}
+	if len(oob) > 0 {
+		_, _, err = client.conn.(*net.UnixConn).WriteMsgUnix(append(jsonBytes, '\n'), oob, nil)
+	} else {
+		_, err = client.conn.Write(append(jsonBytes, '\n'))
+	}
+	client.conn.SetWriteDeadline(time.Time{})
+	client.writeLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case message = <-replyChannel:
+	case <-client.done:
+		/* The reader dispatches everything it read before closing done */
+		select {
+		case message = <-replyChannel:
+		default:
+			return client.Err()
 		}
+	case <-ctx.Done():
+		return fmt.Errorf("qmp command '%s': %w", command, ctx.Err())
+	}
+
+	if message.Error != nil {
+		log.Printf("[QmpClient] command '%s' failed: %s", command, message.Error.Error())
+		return message.Error
 	}
 
-	/* Unmarshal jsonBytes into result */
-	err = json.Unmarshal(jsonBytes, &result)
+	log.Printf("[QmpClient] command '%s' returned [%s]", command, string(message.Return))
 
-	log.Printf("[QmpCommandQuery] execute: result is [%v]", result)
+	if result != nil && len(message.Return) > 0 {
+		err = json.Unmarshal(message.Return, result)
+	}
 
-	return result, err
+	return err
 }
 
-func (event *QmpEventResult) ReadEvent(socket net.Conn) (err error) {
-	var buffer []byte = make([]byte, QmpDefaultBufferSize)
-	var jsonData []byte = make([]byte, 0)
-	var nBytes int
+/*
+ * Subscribe returns a subscription receiving the named events, or every event
+ * if no name is given. Its channel is closed when the connection goes away.
+ */
+func (client *QmpClient) Subscribe(events ...string) *QmpEventSubscription {
+	subscription := &QmpEventSubscription{
+		Events: make(chan *QmpEvent, QmpEventBufferSize),
+		client: client,
+	}
+
+	if len(events) > 0 {
+		subscription.filter = make(map[string]bool)
+		for _, event := range events {
+			subscription.filter[event] = true
+		}
+	}
 
-	var deadLineDuration time.Duration = 10 * 1000000000
+	client.lock.Lock()
+	defer client.lock.Unlock()
 
-	/* Set some deadline to socket */
-	deadLine := time.Now().Add(deadLineDuration)
-	if _err := socket.SetReadDeadline(deadLine); _err != nil {
-		log.Printf("[ReadEvent] could not set socket deadline: %s", _err.Error())
+	if client.err != nil {
+		close(subscription.Events)
+	} else {
+		client.subscriptions = append(client.subscriptions, subscription)
 	}
 
-	log.Printf("[ReadEvent] reading data from socket")
-	for nBytes, err = socket.Read(buffer); err == nil && nBytes > 0; {
-		jsonData = append(jsonData, buffer[:nBytes]...)
+	return subscription
+}
 
-		if nBytes < QmpDefaultBufferSize {
+func (subscription *QmpEventSubscription) Close() {
+	client := subscription.client
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	for index, current := range client.subscriptions {
+		if current == subscription {
+			client.subscriptions = append(client.subscriptions[:index], client.subscriptions[index+1:]...)
+			close(subscription.Events)
 			break
 		}
 	}
+}
 
-	log.Printf("[ReadEvent] socket.read returned: err is %v, nBytes is %d", err, nBytes)
+/* Dropped returns how many events did not fit in Events since the last call */
+func (subscription *QmpEventSubscription) Dropped() (dropped uint64) {
+	client := subscription.client
 
-	/* Reset socket deadline */
-	if _err := socket.SetReadDeadline(time.Unix(0, 0)); _err != nil {
-		log.Printf("[ReadEvent] could not reset socket deadline: %s", _err.Error())
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	dropped, subscription.dropped = subscription.dropped, 0
+	return dropped
+}
+
+func (client *QmpClient) HumanMonitorCommand(ctx context.Context, commandLine string) (output string, err error) {
+	arguments := map[string]string{
+		"command-line": commandLine,
 	}
-	/* Check for err from socket.Read() */
+
+	err = client.Execute(ctx, QmpHumanMonitorCommand, arguments, &output)
+	return output, err
+}
+
+func (client *QmpClient) QueryCommands(ctx context.Context) (commands []string, err error) {
+	var result []struct {
+		Name string `json:"name"`
+	}
+
+	err = client.Execute(ctx, QmpQueryCommandsCommand, nil, &result)
 	if err != nil {
-		return err
-	} else if nBytes == 0 {
-		return fmt.Errorf("no more data")
+		return nil, err
+	}
+
+	commands = make([]string, 0, len(result))
+	for _, command := range result {
+		commands = append(commands, command.Name)
 	}
 
-	log.Printf("[ReadEvent] received from socket: [%s]", string(jsonData))
+	return commands, nil
+}
+
+// Done is closed once the connection to QEMU is gone
+func (client *QmpClient) Done() <-chan struct{} {
+	return client.done
+}
+
+func (client *QmpClient) Err() error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	return client.err
+}
 
-	json.Unmarshal(jsonData, &event)
-	return nil
+func (client *QmpClient) Close() error {
+	return client.conn.Close()
 }
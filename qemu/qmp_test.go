@@ -0,0 +1,445 @@
+package qemuctl_qemu
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testQmpGreeting string = `{"QMP": {"version": {"qemu": {"micro": 1, "minor": 2, "major": 8}, "package": ""}, "capabilities": ["oob"]}}`
+
+/* fakeQmpServer plays QEMU's side of a QMP connection */
+type fakeQmpServer struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (server *fakeQmpServer) write(line string) {
+	if _, err := server.conn.Write([]byte(line + "\n")); err != nil {
+		server.t.Errorf("fake server: write failed: %s", err.Error())
+	}
+}
+
+func (server *fakeQmpServer) send(message interface{}) {
+	jsonBytes, err := json.Marshal(message)
+	if err != nil {
+		server.t.Errorf("fake server: %s", err.Error())
+		return
+	}
+	server.write(string(jsonBytes))
+}
+
+func (server *fakeQmpServer) readCommand() (command qmpCommand) {
+	line, err := server.reader.ReadBytes('\n')
+	if err != nil {
+		server.t.Errorf("fake server: read failed: %s", err.Error())
+		return command
+	}
+
+	if err = json.Unmarshal(line, &command); err != nil {
+		server.t.Errorf("fake server: invalid command [%s]: %s", string(line), err.Error())
+	}
+	return command
+}
+
+/* reply answers the next command, which must be expected, with result */
+func (server *fakeQmpServer) reply(expected string, result interface{}) {
+	command := server.readCommand()
+	if command.Execute != expected {
+		server.t.Errorf("fake server: got command '%s', want '%s'", command.Execute, expected)
+	}
+	server.send(map[string]interface{}{"return": result, "id": command.ID})
+}
+
+/* newTestQmpClient connects a client to a fake server past the greeting */
+func newTestQmpClient(t *testing.T) (client *QmpClient, server *fakeQmpServer) {
+	clientConn, serverConn := net.Pipe()
+	server = &fakeQmpServer{t: t, conn: serverConn, reader: bufio.NewReader(serverConn)}
+
+	go func() {
+		server.write(testQmpGreeting)
+		server.reply(QmpCapabilitiesCommand, struct{}{})
+	}()
+
+	client, err := NewQmpClient(testContext(t), clientConn)
+	if err != nil {
+		t.Fatalf("NewQmpClient: %s", err.Error())
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		serverConn.Close()
+	})
+
+	return client, server
+}
+
+/* TestMain keeps the package's chatty logging out of the test output */
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestNewQmpClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		greeting string
+		reply    string
+		wantErr  string
+	}{
+		{
+			name:     "capabilities accepted",
+			greeting: testQmpGreeting,
+			reply:    `{"return": {}, "id": "ID"}`,
+		},
+		{
+			name:     "invalid greeting",
+			greeting: `QEMU 8.2.1 monitor - type 'help' for more information`,
+			wantErr:  "invalid QMP greeting",
+		},
+		{
+			name:     "capabilities rejected",
+			greeting: testQmpGreeting,
+			reply:    `{"error": {"class": "CommandNotFound", "desc": "no qmp"}, "id": "ID"}`,
+			wantErr:  "no qmp (CommandNotFound)",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+
+			server := &fakeQmpServer{t: t, conn: serverConn, reader: bufio.NewReader(serverConn)}
+			served := make(chan struct{})
+			defer func() { <-served }()
+
+			go func() {
+				defer close(served)
+				server.write(test.greeting)
+				if len(test.reply) > 0 {
+					command := server.readCommand()
+					server.write(strings.ReplaceAll(test.reply, "ID", command.ID))
+				}
+			}()
+
+			client, err := NewQmpClient(testContext(t), clientConn)
+			if len(test.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing '%s'", err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewQmpClient: %s", err.Error())
+			}
+			defer client.Close()
+
+			version := client.Header.QMP.Version.Qemu
+			if version.Major != 8 || version.Minor != 2 || version.Micro != 1 {
+				t.Errorf("got version %d.%d.%d, want 8.2.1", version.Major, version.Minor, version.Micro)
+			}
+		})
+	}
+}
+
+func TestQmpClientRepliesById(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int
+	}{
+		{name: "in order", order: []int{0, 1, 2}},
+		{name: "reversed", order: []int{2, 1, 0}},
+		{name: "interleaved", order: []int{1, 2, 0}},
+	}
+
+	type outcome struct {
+		n      int
+		result int
+		err    error
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client, server := newTestQmpClient(t)
+			ctx := testContext(t)
+			outcomes := make(chan outcome, len(test.order))
+
+			for n := range test.order {
+				go func(n int) {
+					var result int
+					err := client.Execute(ctx, "test-echo", map[string]int{"n": n}, &result)
+					outcomes <- outcome{n: n, result: result, err: err}
+				}(n)
+			}
+
+			/* The commands may arrive in any order: index them by their argument */
+			commands := make(map[int]qmpCommand)
+			for range test.order {
+				command := server.readCommand()
+				arguments, _ := command.Arguments.(map[string]interface{})
+				n, _ := arguments["n"].(float64)
+				commands[int(n)] = command
+			}
+
+			for _, n := range test.order {
+				server.send(map[string]interface{}{"return": n * 10, "id": commands[n].ID})
+			}
+
+			for range test.order {
+				got := <-outcomes
+				if got.err != nil {
+					t.Errorf("command %d: %s", got.n, got.err.Error())
+				} else if got.result != got.n*10 {
+					t.Errorf("command %d: got %d, want %d", got.n, got.result, got.n*10)
+				}
+			}
+		})
+	}
+}
+
+func TestQmpClientFraming(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+	}{
+		{
+			name:   "single line",
+			writes: []string{`{"return": 42, "id": "ID"}` + "\n"},
+		},
+		{
+			name:   "split across writes",
+			writes: []string{`{"return": `, `42, "id"`, `: "ID"}` + "\n"},
+		},
+		{
+			name:   "blank lines and garbage first",
+			writes: []string{"\n", "  \r\n", "not json\n", `{"return": 42, "id": "ID"}` + "\n"},
+		},
+		{
+			name:   "unknown id first",
+			writes: []string{`{"return": 1, "id": "qemuctl-999"}` + "\n", `{"return": 42, "id": "ID"}` + "\n"},
+		},
+		{
+			name:   "event first",
+			writes: []string{`{"event": "RESUME", "timestamp": {"seconds": 1, "microseconds": 2}}` + "\n", `{"return": 42, "id": "ID"}` + "\n"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client, server := newTestQmpClient(t)
+
+			go func() {
+				command := server.readCommand()
+				for _, write := range test.writes {
+					if _, err := server.conn.Write([]byte(strings.ReplaceAll(write, "ID", command.ID))); err != nil {
+						t.Errorf("fake server: write failed: %s", err.Error())
+						return
+					}
+				}
+			}()
+
+			var result int
+			if err := client.Execute(testContext(t), "test-framing", nil, &result); err != nil {
+				t.Fatalf("Execute: %s", err.Error())
+			}
+			if result != 42 {
+				t.Errorf("got %d, want 42", result)
+			}
+		})
+	}
+}
+
+func TestQmpClientErrorReply(t *testing.T) {
+	tests := []struct {
+		class       string
+		description string
+		wantText    string
+	}{
+		{QmpErrorClassGenericError, "Invalid parameter", "Invalid parameter (GenericError)"},
+		{QmpErrorClassDeviceNotFound, "Device 'nic1' not found", "Device 'nic1' not found (DeviceNotFound)"},
+		{QmpErrorClassCommandNotFound, "The command x has not been found", "The command x has not been found (CommandNotFound)"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.class, func(t *testing.T) {
+			client, server := newTestQmpClient(t)
+
+			go func() {
+				command := server.readCommand()
+				server.send(map[string]interface{}{
+					"error": map[string]string{"class": test.class, "desc": test.description},
+					"id":    command.ID,
+				})
+			}()
+
+			err := client.Execute(testContext(t), "test-error", nil, nil)
+			if err == nil {
+				t.Fatalf("got no error")
+			}
+
+			if err.Error() != test.wantText {
+				t.Errorf("got '%s', want '%s'", err.Error(), test.wantText)
+			}
+			if !IsQmpErrorClass(err, test.class) {
+				t.Errorf("IsQmpErrorClass(err, %s) is false", test.class)
+			}
+			if IsQmpErrorClass(err, QmpErrorClassKVMMissingCap) {
+				t.Errorf("IsQmpErrorClass(err, %s) is true", QmpErrorClassKVMMissingCap)
+			}
+		})
+	}
+
+	if IsQmpErrorClass(errors.New("plain"), QmpErrorClassGenericError) {
+		t.Errorf("IsQmpErrorClass is true for a non-QMP error")
+	}
+}
+
+func TestQmpClientEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter []string
+		events []string
+		want   []string
+	}{
+		{
+			name:   "no filter",
+			events: []string{"STOP", "RESUME", "SHUTDOWN"},
+			want:   []string{"STOP", "RESUME", "SHUTDOWN"},
+		},
+		{
+			name:   "single event",
+			filter: []string{"SHUTDOWN"},
+			events: []string{"STOP", "RESUME", "SHUTDOWN"},
+			want:   []string{"SHUTDOWN"},
+		},
+		{
+			name:   "several events",
+			filter: []string{"STOP", "RESUME"},
+			events: []string{"STOP", "DEVICE_DELETED", "RESUME", "STOP"},
+			want:   []string{"STOP", "RESUME", "STOP"},
+		},
+		{
+			name:   "nothing matches",
+			filter: []string{"BALLOON_CHANGE"},
+			events: []string{"STOP", "RESUME"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client, server := newTestQmpClient(t)
+			subscription := client.Subscribe(test.filter...)
+			defer subscription.Close()
+
+			go func() {
+				for index, event := range test.events {
+					server.send(map[string]interface{}{
+						"event":     event,
+						"data":      map[string]int{"index": index},
+						"timestamp": map[string]int64{"seconds": 1700000000, "microseconds": int64(index)},
+					})
+				}
+				server.reply(QmpQueryStatusCommand, QmpStatusInfo{Status: "running", Running: true})
+			}()
+
+			/* Events are dispatched in order, so they are all queued once this returns */
+			if err := client.Execute(testContext(t), QmpQueryStatusCommand, nil, nil); err != nil {
+				t.Fatalf("Execute: %s", err.Error())
+			}
+
+			var got []string
+			for len(subscription.Events) > 0 {
+				event := <-subscription.Events
+				if event.Timestamp.Seconds != 1700000000 || len(event.Data) == 0 {
+					t.Errorf("event %s lost its timestamp or data: %s", event.Event, event.String())
+				}
+				got = append(got, event.Event)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQmpClientDropsEventsWhenFull(t *testing.T) {
+	const extra = 3
+
+	client, server := newTestQmpClient(t)
+	subscription := client.Subscribe()
+	defer subscription.Close()
+
+	go func() {
+		for i := 0; i < QmpEventBufferSize+extra; i++ {
+			server.write(`{"event": "RTC_CHANGE", "timestamp": {"seconds": 1, "microseconds": 0}}`)
+		}
+		server.reply(QmpQueryStatusCommand, QmpStatusInfo{})
+	}()
+
+	if err := client.Execute(testContext(t), QmpQueryStatusCommand, nil, nil); err != nil {
+		t.Fatalf("Execute: %s", err.Error())
+	}
+
+	if dropped := subscription.Dropped(); dropped != extra {
+		t.Errorf("got %d dropped events, want %d", dropped, extra)
+	}
+	if dropped := subscription.Dropped(); dropped != 0 {
+		t.Errorf("Dropped did not reset: got %d", dropped)
+	}
+	if len(subscription.Events) != QmpEventBufferSize {
+		t.Errorf("got %d queued events, want %d", len(subscription.Events), QmpEventBufferSize)
+	}
+}
+
+func TestQmpClientClosed(t *testing.T) {
+	client, server := newTestQmpClient(t)
+	subscription := client.Subscribe()
+
+	go func() {
+		server.readCommand()
+		server.conn.Close()
+	}()
+
+	err := client.Execute(testContext(t), QmpQueryStatusCommand, nil, nil)
+	if !errors.Is(err, ErrQmpClosed) {
+		t.Fatalf("pending command: got %v, want %v", err, ErrQmpClosed)
+	}
+
+	<-client.Done()
+	if _, ok := <-subscription.Events; ok {
+		t.Errorf("subscription channel still open")
+	}
+
+	if err = client.Execute(testContext(t), QmpQueryStatusCommand, nil, nil); !errors.Is(err, ErrQmpClosed) {
+		t.Errorf("later command: got %v, want %v", err, ErrQmpClosed)
+	}
+
+	if _, ok := <-client.Subscribe("STOP").Events; ok {
+		t.Errorf("subscribing after close returned an open channel")
+	}
+}
@@ -0,0 +1,174 @@
+package qemuctl_qemu
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	QmpScreendumpCommand string = "screendump"
+
+	QemuScreendumpFormatPNG string = "png"
+	QemuScreendumpFormatPPM string = "ppm"
+)
+
+/*
+ * screendump has QEMU write the screen as format into a file we open as root
+ * in a private directory; QEMU runs as 'runAs' and gets the file through an
+ * fd set, so nothing it could be tricked into opening is read back.
+ */
+func (monitor *QemuMonitor) screendump(ctx context.Context, client *QmpClient, tempDir string, format string) (path string, err error) {
+	path = filepath.Join(tempDir, "screen."+format)
+
+	/* QEMU opens the fd set write only; the access modes must match */
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fdSetID, err := client.AddFileToFdSet(ctx, file)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if _err := client.RemoveFdSet(ctx, fdSetID); _err != nil {
+			log.Printf("[screendump] could not remove fd set %d: %s", fdSetID, _err.Error())
+		}
+	}()
+
+	arguments := map[string]string{"filename": fmt.Sprintf("/dev/fdset/%d", fdSetID)}
+	if format == QemuScreendumpFormatPNG {
+		arguments["format"] = QemuScreendumpFormatPNG
+	}
+
+	return path, client.Execute(ctx, QmpScreendumpCommand, arguments, nil)
+}
+
+/*
+ * Screenshot returns the guest display as PNG data. QEMU older than 7.1 can
+ * only write PPM, which is converted here.
+ */
+func (monitor *QemuMonitor) Screenshot(ctx context.Context) (data []byte, err error) {
+	var client *QmpClient
+
+	/* 0700 and root's: only QEMU, through the fd we pass, writes in there */
+	tempDir, err := os.MkdirTemp("", "qemuctl-screendump-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	pngFile, err := monitor.screendump(ctx, client, tempDir, QemuScreendumpFormatPNG)
+	if err == nil {
+		return os.ReadFile(pngFile)
+	}
+
+	if !IsQmpErrorClass(err, QmpErrorClassGenericError) {
+		return nil, err
+	}
+
+	log.Printf("[Screenshot] PNG screendump failed (%s); falling back to PPM", err.Error())
+
+	ppmFile, err := monitor.screendump(ctx, client, tempDir, QemuScreendumpFormatPPM)
+	if err != nil {
+		return nil, err
+	}
+
+	ppmHandle, err := os.Open(ppmFile)
+	if err != nil {
+		return nil, err
+	}
+	defer ppmHandle.Close()
+
+	screen, err := DecodePPM(ppmHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	if err = png.Encode(&buffer, screen); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+/* readPPMField reads one whitespace separated header field, skipping comments */
+func readPPMField(reader *bufio.Reader) (field string, err error) {
+	for {
+		char, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case char == '#':
+			if _, err = reader.ReadString('\n'); err != nil {
+				return "", err
+			}
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r':
+			if len(field) > 0 {
+				return field, nil
+			}
+		default:
+			field += string(char)
+		}
+	}
+}
+
+/* DecodePPM decodes a binary (P6) PPM image, which is what screendump writes */
+func DecodePPM(input io.Reader) (screen image.Image, err error) {
+	var width, height, maxValue int
+	var reader *bufio.Reader = bufio.NewReader(input)
+	var fields [4]string
+
+	for index := range fields {
+		if fields[index], err = readPPMField(reader); err != nil {
+			return nil, fmt.Errorf("invalid PPM header: %s", err.Error())
+		}
+	}
+
+	if fields[0] != "P6" {
+		return nil, fmt.Errorf("unsupported PPM type '%s'", fields[0])
+	}
+
+	_, err = fmt.Sscanf(fields[1]+" "+fields[2]+" "+fields[3], "%d %d %d", &width, &height, &maxValue)
+	if err != nil || width <= 0 || height <= 0 || maxValue <= 0 || maxValue > 255 {
+		return nil, fmt.Errorf("invalid PPM header '%s %s %s'", fields[1], fields[2], fields[3])
+	}
+
+	pixels := make([]byte, width*height*3)
+	if _, err = io.ReadFull(reader, pixels); err != nil {
+		return nil, fmt.Errorf("truncated PPM data: %s", err.Error())
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for offset := 0; offset < len(pixels); offset += 3 {
+		pixel := offset / 3
+		rgba.SetRGBA(pixel%width, pixel/width, color.RGBA{
+			R: uint8(int(pixels[offset]) * 255 / maxValue),
+			G: uint8(int(pixels[offset+1]) * 255 / maxValue),
+			B: uint8(int(pixels[offset+2]) * 255 / maxValue),
+			A: 255,
+		})
+	}
+
+	return rgba, nil
+}
@@ -0,0 +1,110 @@
+package qemuctl_qemu
+
+import (
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestDecodePPM(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		width   int
+		height  int
+		want    []color.RGBA
+		wantErr string
+	}{
+		{
+			name:   "2x1 image",
+			input:  "P6\n2 1\n255\n\xff\x00\x00\x00\x80\xff",
+			width:  2,
+			height: 1,
+			want:   []color.RGBA{{255, 0, 0, 255}, {0, 128, 255, 255}},
+		},
+		{
+			name:   "1x2 image with comments",
+			input:  "P6\n# CREATOR: QEMU\n1 # width\n2\n255\n\x01\x02\x03\x04\x05\x06",
+			width:  1,
+			height: 2,
+			want:   []color.RGBA{{1, 2, 3, 255}, {4, 5, 6, 255}},
+		},
+		{
+			name:   "header on one line",
+			input:  "P6 1 1 255 \x10\x20\x30",
+			width:  1,
+			height: 1,
+			want:   []color.RGBA{{16, 32, 48, 255}},
+		},
+		{
+			name:   "max value below 255 is scaled",
+			input:  "P6\n1 1\n15\n\x0f\x00\x05",
+			width:  1,
+			height: 1,
+			want:   []color.RGBA{{255, 0, 85, 255}},
+		},
+		{
+			name:    "ASCII PPM",
+			input:   "P3\n1 1\n255\n1 2 3\n",
+			wantErr: "unsupported PPM type 'P3'",
+		},
+		{
+			name:    "not a PPM",
+			input:   "BM 1 1 255 \x00\x00\x00",
+			wantErr: "unsupported PPM type 'BM'",
+		},
+		{
+			name:    "missing fields",
+			input:   "P6\n1 1\n",
+			wantErr: "invalid PPM header",
+		},
+		{
+			name:    "zero width",
+			input:   "P6\n0 1\n255\n",
+			wantErr: "invalid PPM header '0 1 255'",
+		},
+		{
+			name:    "16 bit samples",
+			input:   "P6\n1 1\n65535\n\x00\x00\x00\x00\x00\x00",
+			wantErr: "invalid PPM header '1 1 65535'",
+		},
+		{
+			name:    "non numeric size",
+			input:   "P6\nwide 1\n255\n",
+			wantErr: "invalid PPM header",
+		},
+		{
+			name:    "truncated pixels",
+			input:   "P6\n2 2\n255\n\x00\x00\x00\x00",
+			wantErr: "truncated PPM data",
+		},
+	}
+
+	for _, test := range tests {
+		screen, err := DecodePPM(strings.NewReader(test.input))
+		if len(test.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want one containing '%s'", test.name, err, test.wantErr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		bounds := screen.Bounds()
+		if bounds.Dx() != test.width || bounds.Dy() != test.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", test.name, bounds.Dx(), bounds.Dy(), test.width, test.height)
+			continue
+		}
+
+		for index, want := range test.want {
+			got := color.RGBAModel.Convert(screen.At(index%test.width, index/test.width)).(color.RGBA)
+			if got != want {
+				t.Errorf("%s: pixel %d = %v, want %v", test.name, index, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,563 @@
+package qemuctl_qemu
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	QemuImgBinary string = "qemu-img"
+
+	QmpQueryBlockCommand     string = "query-block"
+	QmpQueryJobsCommand      string = "query-jobs"
+	QmpJobDismissCommand     string = "job-dismiss"
+	QmpJobCancelCommand      string = "job-cancel"
+	QmpSnapshotSaveCommand   string = "snapshot-save"
+	QmpSnapshotLoadCommand   string = "snapshot-load"
+	QmpSnapshotDeleteCommand string = "snapshot-delete"
+
+	QmpQueryNamedBlockNodesCommand string = "query-named-block-nodes"
+	QmpTransactionCommand          string = "transaction"
+	QmpBlockdevSnapshotSyncCommand string = "blockdev-snapshot-sync"
+	QmpBlockCommitCommand          string = "block-commit"
+	QmpJobCompleteCommand          string = "job-complete"
+
+	QmpJobStatusConcluded string = "concluded"
+	QmpJobStatusReady     string = "ready"
+	QmpJobPollInterval           = 500 * time.Millisecond
+)
+
+type QemuSnapshot struct {
+	ID          string
+	Name        string
+	VMStateSize string
+	Date        time.Time
+	VMClock     string
+	File        string
+}
+
+// QemuBlockNode is a format node of the running machine and the file it opens
+type QemuBlockNode struct {
+	Device   string
+	QdevPath string
+	NodeName string
+	File     string
+	Format   string
+}
+
+type qmpSnapshotInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	VMStateSize int64  `json:"vm-state-size"`
+	DateSec     int64  `json:"date-sec"`
+	DateNsec    int64  `json:"date-nsec"`
+	VMClockSec  int64  `json:"vm-clock-sec"`
+	VMClockNsec int64  `json:"vm-clock-nsec"`
+}
+
+type qmpBlockInfo struct {
+	Device   string `json:"device"`
+	QdevPath string `json:"qdev"`
+	Inserted *struct {
+		NodeName string `json:"node-name"`
+		File     string `json:"file"`
+		Driver   string `json:"drv"`
+		Image    struct {
+			Snapshots []qmpSnapshotInfo `json:"snapshots"`
+		} `json:"image"`
+	} `json:"inserted"`
+}
+
+type qmpNamedBlockNode struct {
+	NodeName string `json:"node-name"`
+	File     string `json:"file"`
+	Driver   string `json:"drv"`
+	Image    struct {
+		VirtualSize int64 `json:"virtual-size"`
+	} `json:"image"`
+	DirtyBitmaps []struct {
+		Name       string `json:"name"`
+		Persistent bool   `json:"persistent"`
+	} `json:"dirty-bitmaps"`
+}
+
+type qmpJobInfo struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	Status          string `json:"status"`
+	CurrentProgress int64  `json:"current-progress"`
+	TotalProgress   int64  `json:"total-progress"`
+	Error           string `json:"error"`
+}
+
+// QemuJobProgress is called while a block job runs, with its progress so far
+type QemuJobProgress func(current int64, total int64)
+
+func formatVMClock(seconds int64, nanoseconds int64) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		seconds/3600, (seconds/60)%60, seconds%60, nanoseconds/1000000)
+}
+
+func (monitor *QemuMonitor) queryBlock(ctx context.Context, client *QmpClient) (blocks []qmpBlockInfo, err error) {
+	err = client.Execute(ctx, QmpQueryBlockCommand, nil, &blocks)
+	return blocks, err
+}
+
+/*
+ * QueryBlockNodes returns the format nodes of the machine's block devices
+ * that have media inserted.
+ */
+func (monitor *QemuMonitor) QueryBlockNodes(ctx context.Context, client *QmpClient) (nodes []QemuBlockNode, err error) {
+	blocks, err := monitor.queryBlock(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, block := range blocks {
+		if block.Inserted == nil {
+			continue
+		}
+
+		nodes = append(nodes, QemuBlockNode{
+			Device:   block.Device,
+			QdevPath: block.QdevPath,
+			NodeName: block.Inserted.NodeName,
+			File:     block.Inserted.File,
+			Format:   block.Inserted.Driver,
+		})
+	}
+
+	return nodes, nil
+}
+
+/* snapshotNodes maps image files to the node names QEMU gave them */
+func (monitor *QemuMonitor) snapshotNodes(ctx context.Context, client *QmpClient, files []string) (nodeNames []string, err error) {
+	nodes, err := monitor.QueryBlockNodes(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		found := false
+		for _, node := range nodes {
+			if node.File == file && node.Format == QemuDiskFormatQcow2 {
+				nodeNames = append(nodeNames, node.NodeName)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("no qcow2 block node found for '%s'", file)
+		}
+	}
+
+	if len(nodeNames) == 0 {
+		return nil, fmt.Errorf("machine '%s' has no qcow2 images", monitor.Machine.Name)
+	}
+
+	return nodeNames, nil
+}
+
+/*
+ * WaitJob polls query-jobs until the job concludes, dismisses it and returns
+ * the job's error, if any. Block jobs must be started with auto-dismiss off,
+ * otherwise a failed job vanishes before we can see its error.
+ */
+func (monitor *QemuMonitor) WaitJob(ctx context.Context, client *QmpClient, jobID string, progress QemuJobProgress) (err error) {
+	var ticker *time.Ticker = time.NewTicker(QmpJobPollInterval)
+	var completed bool = false
+	defer ticker.Stop()
+
+	for {
+		var jobs []qmpJobInfo
+		var job *qmpJobInfo = nil
+
+		err = client.Execute(ctx, QmpQueryJobsCommand, nil, &jobs)
+		if err != nil {
+			return err
+		}
+
+		for index := range jobs {
+			if jobs[index].ID == jobID {
+				job = &jobs[index]
+				break
+			}
+		}
+
+		if job == nil {
+			return fmt.Errorf("job '%s' disappeared before it concluded", jobID)
+		}
+
+		if progress != nil {
+			progress(job.CurrentProgress, job.TotalProgress)
+		}
+
+		/* Jobs such as an active block-commit wait in 'ready' to be completed */
+		if job.Status == QmpJobStatusReady && !completed {
+			completed = true
+			log.Printf("[WaitJob] job '%s' is ready; completing it", jobID)
+			err = client.Execute(ctx, QmpJobCompleteCommand, map[string]string{"id": jobID}, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		if job.Status == QmpJobStatusConcluded {
+			log.Printf("[WaitJob] job '%s' concluded (error: '%s')", jobID, job.Error)
+			if _err := client.Execute(ctx, QmpJobDismissCommand, map[string]string{"id": jobID}, nil); _err != nil {
+				log.Printf("[WaitJob] could not dismiss job '%s': %s", jobID, _err.Error())
+			}
+
+			if len(job.Error) > 0 {
+				return fmt.Errorf("job '%s' failed: %s", jobID, job.Error)
+			}
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("job '%s' did not finish: %w", jobID, ctx.Err())
+		}
+	}
+}
+
+/*
+ * cancelJob cancels a job we stopped waiting for and waits for it to
+ * conclude, so the nodes it holds can be released.
+ */
+func (monitor *QemuMonitor) cancelJob(client *QmpClient, jobID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), QmpDefaultTimeout)
+	defer cancel()
+
+	log.Printf("[cancelJob] cancelling job '%s'", jobID)
+	if err := client.Execute(ctx, QmpJobCancelCommand, map[string]string{"id": jobID}, nil); err != nil {
+		log.Printf("[cancelJob] could not cancel job '%s': %s", jobID, err.Error())
+		return
+	}
+
+	if err := monitor.WaitJob(ctx, client, jobID, nil); err != nil {
+		log.Printf("[cancelJob] job '%s': %s", jobID, err.Error())
+	}
+}
+
+func (monitor *QemuMonitor) runSnapshotJob(ctx context.Context, command string, name string, files []string, withState bool, progress QemuJobProgress) (err error) {
+	var client *QmpClient
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	nodeNames, err := monitor.snapshotNodes(ctx, client, files)
+	if err != nil {
+		return err
+	}
+
+	jobID := fmt.Sprintf("qemuctl-%s-%d", command, time.Now().Unix())
+	arguments := map[string]interface{}{
+		"job-id":  jobID,
+		"tag":     name,
+		"devices": nodeNames,
+	}
+
+	/* VM state lives in the first image */
+	if withState {
+		arguments["vmstate"] = nodeNames[0]
+	}
+
+	log.Printf("[runSnapshotJob] %s '%s' on nodes %v", command, name, nodeNames)
+	err = client.Execute(ctx, command, arguments, nil)
+	if err != nil {
+		return err
+	}
+
+	err = monitor.WaitJob(ctx, client, jobID, progress)
+	if err != nil {
+		monitor.cancelJob(client, jobID)
+	}
+
+	return err
+}
+
+func (monitor *QemuMonitor) SaveSnapshot(ctx context.Context, name string, files []string, progress QemuJobProgress) error {
+	return monitor.runSnapshotJob(ctx, QmpSnapshotSaveCommand, name, files, true, progress)
+}
+
+func (monitor *QemuMonitor) LoadSnapshot(ctx context.Context, name string, files []string, progress QemuJobProgress) error {
+	return monitor.runSnapshotJob(ctx, QmpSnapshotLoadCommand, name, files, true, progress)
+}
+
+func (monitor *QemuMonitor) DeleteSnapshot(ctx context.Context, name string, files []string, progress QemuJobProgress) error {
+	return monitor.runSnapshotJob(ctx, QmpSnapshotDeleteCommand, name, files, false, progress)
+}
+
+func (monitor *QemuMonitor) ListSnapshots(ctx context.Context, files []string) (snapshots []QemuSnapshot, err error) {
+	var client *QmpClient
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	blocks, err := monitor.queryBlock(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		for _, block := range blocks {
+			if block.Inserted == nil || block.Inserted.File != file {
+				continue
+			}
+
+			for _, info := range block.Inserted.Image.Snapshots {
+				snapshots = append(snapshots, QemuSnapshot{
+					ID:          info.ID,
+					Name:        info.Name,
+					VMStateSize: fmt.Sprintf("%d B", info.VMStateSize),
+					Date:        time.Unix(info.DateSec, info.DateNsec),
+					VMClock:     formatVMClock(info.VMClockSec, info.VMClockNsec),
+					File:        file,
+				})
+			}
+		}
+	}
+
+	return snapshots, nil
+}
+
+/* findFormatNode returns the format node (qcow2, raw...) that opens file */
+func (monitor *QemuMonitor) findFormatNode(ctx context.Context, client *QmpClient, file string) (node *qmpNamedBlockNode, err error) {
+	var nodes []qmpNamedBlockNode
+
+	err = client.Execute(ctx, QmpQueryNamedBlockNodesCommand, map[string]bool{"flat": true}, &nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	for index := range nodes {
+		/* skip protocol nodes, we want the format node on top of them */
+		if nodes[index].File == file && nodes[index].Driver != "file" && nodes[index].Driver != "host_device" {
+			return &nodes[index], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no block node found for '%s'", file)
+}
+
+func (monitor *QemuMonitor) formatNodeForFile(ctx context.Context, client *QmpClient, file string) (nodeName string, err error) {
+	node, err := monitor.findFormatNode(ctx, client, file)
+	if err != nil {
+		return "", err
+	}
+
+	return node.NodeName, nil
+}
+
+/*
+ * External snapshots: the active image of each disk gets a new qcow2 overlay
+ * on top, and block-commit later folds the overlays back into the base image.
+ * CreateExternalSnapshots atomically adds an overlay to each image (active image -> overlay).
+ * QEMU runs as 'runAs' by now and may not create files next to the images,
+ * so the overlays are created here and handed to it.
+ */
+func (monitor *QemuMonitor) CreateExternalSnapshots(ctx context.Context, overlays map[string]string) (err error) {
+	var client *QmpClient
+	var actions []interface{}
+	var created []string
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	/* Do not leave overlays QEMU never took behind */
+	defer func() {
+		if err != nil {
+			for _, overlay := range created {
+				if _err := os.Remove(overlay); _err != nil {
+					log.Printf("[CreateExternalSnapshots] could not remove '%s': %s", overlay, _err.Error())
+				}
+			}
+		}
+	}()
+
+	for activeImage, overlay := range overlays {
+		var node *qmpNamedBlockNode
+
+		if node, err = monitor.findFormatNode(ctx, client, activeImage); err != nil {
+			return err
+		}
+
+		if err = QemuImgCreateOverlayOfSize(activeImage, node.Driver, overlay, node.Image.VirtualSize); err != nil {
+			return err
+		}
+		created = append(created, overlay)
+
+		if err = monitor.ChownToRunAs(overlay); err != nil {
+			return err
+		}
+
+		log.Printf("[CreateExternalSnapshots] node '%s' (%s) gets overlay '%s'", node.NodeName, activeImage, overlay)
+		actions = append(actions, map[string]interface{}{
+			"type": QmpBlockdevSnapshotSyncCommand,
+			"data": map[string]string{
+				"node-name":     node.NodeName,
+				"snapshot-file": overlay,
+				"format":        QemuDiskFormatQcow2,
+				"mode":          "existing",
+			},
+		})
+	}
+
+	return client.Execute(ctx, QmpTransactionCommand, map[string]interface{}{"actions": actions}, nil)
+}
+
+/* CommitExternalSnapshots merges everything above baseImage into it, making baseImage active again */
+func (monitor *QemuMonitor) CommitExternalSnapshots(ctx context.Context, activeImage string, baseImage string, progress QemuJobProgress) (err error) {
+	var client *QmpClient
+
+	client, err = monitor.GetControlSocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	topNode, err := monitor.formatNodeForFile(ctx, client, activeImage)
+	if err != nil {
+		return err
+	}
+
+	baseNode, err := monitor.formatNodeForFile(ctx, client, baseImage)
+	if err != nil {
+		return err
+	}
+
+	jobID := fmt.Sprintf("qemuctl-commit-%s-%d", topNode, time.Now().Unix())
+	log.Printf("[CommitExternalSnapshots] committing '%s' into '%s'", topNode, baseNode)
+
+	err = client.Execute(ctx, QmpBlockCommitCommand, map[string]interface{}{
+		"job-id":       jobID,
+		"device":       topNode,
+		"base-node":    baseNode,
+		"auto-dismiss": false,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	/* Leave nothing running while machine data still lists the overlay */
+	err = monitor.WaitJob(ctx, client, jobID, progress)
+	if err != nil {
+		monitor.cancelJob(client, jobID)
+	}
+
+	return err
+}
+
+func QemuImgCreateOverlay(backingImage string, backingFormat string, overlay string) (err error) {
+	_, err = runQemuImg("create", "-f", QemuDiskFormatQcow2, "-b", backingImage, "-F", backingFormat, overlay)
+	return err
+}
+
+/*
+ * QemuImgCreateOverlayOfSize creates an overlay without opening the backing
+ * image, which a running QEMU keeps locked.
+ */
+func QemuImgCreateOverlayOfSize(backingImage string, backingFormat string, overlay string, size int64) (err error) {
+	_, err = runQemuImg("create", "-f", QemuDiskFormatQcow2, "-u", "-b", backingImage, "-F", backingFormat,
+		overlay, strconv.FormatInt(size, 10))
+	return err
+}
+
+func QemuImgCommit(activeImage string, baseImage string) (err error) {
+	_, err = runQemuImg("commit", "-b", baseImage, activeImage)
+	return err
+}
+
+/*
+ * Offline snapshot handling, for stopped machines: qemu-img works directly
+ * on the image files.
+ */
+func runQemuImg(arguments ...string) (output string, err error) {
+	qemuImgPath, err := exec.LookPath(QemuImgBinary)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("[qemu-img] running '%s %s'", qemuImgPath, strings.Join(arguments, " "))
+	outputBytes, err := exec.Command(qemuImgPath, arguments...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("qemu-img %s: %s", arguments[0], strings.TrimSpace(string(outputBytes)))
+	}
+
+	return string(outputBytes), nil
+}
+
+func QemuImgSnapshot(operation string, file string, name string) (err error) {
+	var flag string
+
+	switch operation {
+	case QmpSnapshotSaveCommand:
+		flag = "-c"
+	case QmpSnapshotLoadCommand:
+		flag = "-a"
+	case QmpSnapshotDeleteCommand:
+		flag = "-d"
+	default:
+		return fmt.Errorf("unknown snapshot operation '%s'", operation)
+	}
+
+	_, err = runQemuImg("snapshot", flag, name, file)
+	return err
+}
+
+/*
+ * ListImageSnapshots parses 'qemu-img snapshot -l' output:
+ *
+ *   Snapshot list:
+ *   ID        TAG               VM SIZE                DATE     VM CLOCK     ICOUNT
+ *   1         clean             0 B 2023-02-01 10:00:00 00:00:00.000          0
+ */
+func ListImageSnapshots(file string) (snapshots []QemuSnapshot, err error) {
+	var lineRegex *regexp.Regexp = regexp.MustCompile(
+		`^(\S+)\s+(\S+)\s+(.*?)\s*(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})\s+(\S+)`)
+
+	output, err := runQemuImg("snapshot", "-l", file)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		matches := lineRegex.FindStringSubmatch(scanner.Text())
+		if matches == nil || matches[1] == "ID" {
+			continue
+		}
+
+		date, _ := time.ParseInLocation("2006-01-02 15:04:05", matches[4], time.Local)
+		snapshots = append(snapshots, QemuSnapshot{
+			ID:          matches[1],
+			Name:        matches[2],
+			VMStateSize: matches[3],
+			Date:        date,
+			VMClock:     matches[5],
+			File:        file,
+		})
+	}
+
+	return snapshots, nil
+}
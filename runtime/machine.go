@@ -22,6 +22,8 @@ const (
 	MachineStatusStarted     string = "started"
 	MachineStatusRunning     string = "running"
 	MachineStatusStopped     string = "stopped"
+	MachineStatusPaused      string = "paused"
+	MachineStatusSaved       string = "saved"
 	MachineStatusDegraded    string = "degraded"
 	MachineStatusUnknown     string = "unknown"
 	MachineDataFileName      string = "machine-data.json"
@@ -30,11 +32,14 @@ const (
 )
 
 type MachineData struct {
-	QemuPid      int    `json:"qemuProcessPID"`
-	State        string `json:"machineState"`
-	SSHLocalPort int    `json:"sshLocalPort"`
-	BiosFile     string `json:"biosFile"`
-	CommandLine  string `json:"cmdline"`
+	QemuPid      int                 `json:"qemuProcessPID"`
+	State        string              `json:"machineState"`
+	SSHLocalPort int                 `json:"sshLocalPort"`
+	BiosFile     string              `json:"biosFile"`
+	CommandLine  string              `json:"cmdline"`
+	DiskChains   map[string][]string `json:"diskChains,omitempty"`
+	MigratedTo   string              `json:"migratedTo,omitempty"`
+	SavedPaused  bool                `json:"savedPaused,omitempty"`
 }
 
 type Machine struct {
@@ -48,6 +53,9 @@ type Machine struct {
 	initialized      bool
 	CommandLine      string
 	SpiceSocket      string
+	DiskChains       map[string][]string // base image -> external overlays, oldest first
+	MigratedTo       string              // machine the guest was live migrated to, if any
+	SavedPaused      bool                // the guest was paused when its state was saved
 }
 
 func NewMachine(machineName string) (machine *Machine) {
@@ -76,6 +84,7 @@ func NewMachine(machineName string) (machine *Machine) {
 		initialized:      false,
 		CommandLine:      "",
 		SpiceSocket:      "",
+		DiskChains:       make(map[string][]string),
 	}
 
 	fileData, err := os.ReadFile(dataFile)
@@ -97,9 +106,14 @@ func NewMachine(machineName string) (machine *Machine) {
 	machine.SSHLocalPort = machineData.SSHLocalPort
 	machine.Status = machineData.State
 	machine.CommandLine = machineData.CommandLine
+	if machineData.DiskChains != nil {
+		machine.DiskChains = machineData.DiskChains
+	}
+	machine.MigratedTo = machineData.MigratedTo
+	machine.SavedPaused = machineData.SavedPaused
 
 	/* Make sure to check if qemu's process is actually running */
-	if machine.IsRunning() {
+	if machine.IsRunning() || machine.IsPaused() {
 		log.Printf("[machine] checking for pid file")
 		machine.QemuPid = machine.GetPidFileData()
 
@@ -188,6 +202,14 @@ func (m *Machine) IsStopped() bool {
 	return (strings.Compare(MachineStatusStopped, m.Status) == 0)
 }
 
+func (m *Machine) IsPaused() bool {
+	return (strings.Compare(MachineStatusPaused, m.Status) == 0)
+}
+
+func (m *Machine) IsSaved() bool {
+	return (strings.Compare(MachineStatusSaved, m.Status) == 0)
+}
+
 func (m *Machine) IsDegraded() bool {
 	return (strings.Compare(MachineStatusDegraded, m.Status) == 0)
 }
@@ -228,11 +250,15 @@ func (m *Machine) UpdateData() (err error) {
 		State:        m.Status,
 		BiosFile:     m.BiosFile,
 		CommandLine:  commandLine,
+		DiskChains:   m.DiskChains,
+		MigratedTo:   m.MigratedTo,
+		SavedPaused:  m.SavedPaused,
 	}
 
 	switch m.Status {
 	case MachineStatusCreated, MachineStatusRunning, MachineStatusDegraded,
-		MachineStatusStarted, MachineStatusStopped, MachineStatusUnknown:
+		MachineStatusStarted, MachineStatusStopped, MachineStatusPaused, MachineStatusSaved,
+		MachineStatusUnknown:
 		{
 			log.Printf("[UpdateStatus] updating file '%s' with [%v].\n", statusFile, machineData)
 			jsonBytes, err := json.Marshal(machineData)
@@ -324,6 +350,19 @@ func (m *Machine) GetMachineFileData(fileName string) (data []byte, err error) {
 	return data, nil
 }
 
+/*
+ * GetActiveDiskImage returns the image QEMU must open for baseImage: the
+ * newest external overlay if there is any, baseImage itself otherwise.
+ */
+func (m *Machine) GetActiveDiskImage(baseImage string) (activeImage string, isOverlay bool) {
+	chain := m.DiskChains[baseImage]
+	if len(chain) == 0 {
+		return baseImage, false
+	}
+
+	return chain[len(chain)-1], true
+}
+
 func (m *Machine) GetPidFileData() int {
 	var pidFile string = fmt.Sprintf("%s/%s", m.RuntimeDirectory, RuntimeQemuPIDFileName)
 	var fileData []byte = make([]byte, 32)
@@ -1,12 +1,15 @@
 package qemuctl_runtime
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -130,6 +133,50 @@ func FileExists(filePath string) (yes bool) {
 	return (err == nil && !info.IsDir())
 }
 
+/*
+ * ProcessIsAlive tells whether pid refers to a live process. Zombies are
+ * considered dead, since they only wait to be reaped by their parent.
+ */
+func ProcessIsAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(pid, 0)
+	if err == syscall.ESRCH {
+		return false
+	}
+
+	statData, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+
+	/* state is the first field after the command name, which is between parens */
+	statString := string(statData)
+	if index := strings.LastIndex(statString, ")"); index >= 0 && index+2 < len(statString) {
+		return statString[index+2] != 'Z'
+	}
+
+	return true
+}
+
+func WaitProcessExit(ctx context.Context, pid int) (err error) {
+	var ticker *time.Ticker = time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for ProcessIsAlive(pid) {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("process %d is still running: %w", pid, ctx.Err())
+		}
+	}
+
+	log.Printf("[WaitProcessExit] process %d is gone", pid)
+	return nil
+}
+
 func SetupSignalHandler(signalHandler func(signal os.Signal)) {
 
 	log.Println("[signals] setting up signal handler")